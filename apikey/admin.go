@@ -0,0 +1,167 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// AdminPrincipal is a principal as listed by AdminHandler. Key digests are
+// never returned.
+type AdminPrincipal struct {
+	Principal string     `json:"principal"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	Keys      []AdminKey `json:"keys"`
+}
+
+// AdminKey describes a key without its digest.
+type AdminKey struct {
+	ID         string     `json:"id"`
+	Status     KeyStatus  `json:"status"`
+	Scopes     []string   `json:"scopes,omitempty"`
+	NotBefore  *time.Time `json:"not_before,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateKeyRequest is the body of a request to mint a key.
+type CreateKeyRequest struct {
+	Scopes    []string   `json:"scopes,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateKeyResponse returns a newly minted key. Key is the plaintext
+// structured key; only its digest is stored, so it cannot be shown again.
+type CreateKeyResponse struct {
+	Principal string `json:"principal"`
+	AdminKey
+	Key string `json:"key"`
+}
+
+// AdminHandler returns a handler for managing the keys in store, reachable
+// only with a key granting adminScope:
+//
+//	GET  /principals                   list principals, keys and last use
+//	POST /principals/{principal}/keys  mint a key, body CreateKeyRequest
+//	POST /keys/{id}/revoke             revoke a key
+//
+// Mount it under a prefix with http.StripPrefix. Changes made through store
+// take effect for validation immediately when a is configured with the same
+// store.
+func (a *APIKey) AdminHandler(store WritableKeyStore, adminScope string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /principals", func(w http.ResponseWriter, r *http.Request) {
+		principals, err := listPrincipals(r.Context(), store)
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, principals)
+	})
+	mux.HandleFunc("POST /principals/{principal}/keys", func(w http.ResponseWriter, r *http.Request) {
+		principal := r.PathValue("principal")
+		var req CreateKeyRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+				writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+				return
+			}
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			writeAdminError(w, http.StatusBadRequest, errors.New("expires_at must be in the future"))
+			return
+		}
+		generated, err := GenerateKey()
+		if err != nil {
+			writeAdminError(w, http.StatusInternalServerError, err)
+			return
+		}
+		key := Key{ID: generated.ID, Value: HashKey(generated.String()), NotBefore: req.NotBefore, ExpiresAt: req.ExpiresAt, Scopes: req.Scopes}
+		if err := store.AddKey(r.Context(), principal, key); err != nil {
+			status := http.StatusInternalServerError
+			var configErrors ConfigErrors
+			if errors.As(err, &configErrors) {
+				status = http.StatusBadRequest
+			}
+			writeAdminError(w, status, err)
+			return
+		}
+		log.Printf("apikey admin: principal %s created key %s for principal %s", adminPrincipal(r), key.ID, principal)
+		writeJSON(w, http.StatusCreated, CreateKeyResponse{Principal: principal, AdminKey: adminKey(key, nil), Key: generated.String()})
+	})
+	mux.HandleFunc("POST /keys/{id}/revoke", func(w http.ResponseWriter, r *http.Request) {
+		keyID := r.PathValue("id")
+		if err := store.Revoke(r.Context(), keyID); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrKeyNotFound) {
+				status = http.StatusNotFound
+			}
+			writeAdminError(w, status, err)
+			return
+		}
+		log.Printf("apikey admin: principal %s revoked key %s", adminPrincipal(r), keyID)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return a.RequireScopes(mux, adminScope)
+}
+
+func listPrincipals(ctx context.Context, store WritableKeyStore) ([]AdminPrincipal, error) {
+	usage, err := store.LastUsed(ctx)
+	if err != nil {
+		return nil, err
+	}
+	principals := []AdminPrincipal{}
+	for _, entry := range store.KeySet().Config().Principals {
+		principal := AdminPrincipal{Principal: entry.Principal, Scopes: entry.Scopes, Keys: []AdminKey{}}
+		for _, key := range entry.Keys {
+			var lastUsed *time.Time
+			if at, ok := usage[key.ID]; ok && key.ID != "" {
+				lastUsed = &at
+			}
+			principal.Keys = append(principal.Keys, adminKey(key, lastUsed))
+		}
+		principals = append(principals, principal)
+	}
+	return principals, nil
+}
+
+func adminKey(key Key, lastUsed *time.Time) AdminKey {
+	status := key.Status
+	if status == "" {
+		status = KeyStatusActive
+	}
+	return AdminKey{
+		ID:         key.ID,
+		Status:     status,
+		Scopes:     key.Scopes,
+		NotBefore:  key.NotBefore,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: lastUsed,
+	}
+}
+
+func adminPrincipal(r *http.Request) string {
+	principal, _ := PrincipalFromContext(r.Context())
+	return principal
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	detail := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Printf("apikey admin: %s", err)
+		detail = strings.ToLower(http.StatusText(status))
+	}
+	WriteProblem(w, Problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail})
+}
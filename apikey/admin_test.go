@@ -0,0 +1,104 @@
+package apikey
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`[{"principal": "ops", "keys": [{"id": "ops-1", "key": "`+HashKey("0P5K3Y0123456789")+`"}], "scopes": ["apikey:admin"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewJSONFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	adminAPI := &APIKey{Store: store}
+	handler := adminAPI.AdminHandler(store, "apikey:admin")
+
+	serve := func(method, target, key, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/principals/partner/keys", "0P5K3Y0123456789", `{"scopes": ["reports:read"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d but got %d: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	var created CreateKeyResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("invalid response %q: %s", w.Body, err)
+	}
+	if created.Principal != "partner" || created.ID == "" || created.Status != KeyStatusActive {
+		t.Errorf("unexpected created key %+v", created)
+	}
+	if _, err := ParseKey(created.Key); err != nil {
+		t.Errorf("expected a structured key, got %q: %s", created.Key, err)
+	}
+
+	// The new key is usable immediately and its plaintext is not stored.
+	if result := adminAPI.Validate(&http.Request{Header: http.Header{"Authorization": []string{"Bearer " + created.Key}}}); !result.IsValid() || result.Principal != "partner" {
+		t.Errorf("expected created key to be valid, got status %d", result.StatusCode)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), created.Key) || !strings.Contains(string(data), HashKey(created.Key)) {
+		t.Errorf("expected only the digest of the key to be saved, got %s", data)
+	}
+
+	// A non-admin key is refused.
+	if w := serve(http.MethodGet, "/principals", created.Key, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for a non-admin key but got %d", http.StatusForbidden, w.Code)
+	}
+
+	w = serve(http.MethodGet, "/principals", "0P5K3Y0123456789", "")
+	var principals []AdminPrincipal
+	if err := json.Unmarshal(w.Body.Bytes(), &principals); err != nil {
+		t.Fatalf("invalid response %q: %s", w.Body, err)
+	}
+	if len(principals) != 2 || principals[1].Principal != "partner" || len(principals[1].Keys) != 1 {
+		t.Fatalf("unexpected principals %+v", principals)
+	}
+	if principals[0].Keys[0].LastUsedAt == nil || principals[1].Keys[0].LastUsedAt == nil {
+		t.Errorf("expected last use of both keys to be listed, got %+v", principals)
+	}
+	if strings.Contains(w.Body.String(), "sha256:") {
+		t.Errorf("expected digests to be omitted from the listing, got %s", w.Body)
+	}
+
+	if w := serve(http.MethodPost, "/keys/"+created.ID+"/revoke", "0P5K3Y0123456789", ""); w.Code != http.StatusNoContent {
+		t.Errorf("expected status %d but got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	if result := adminAPI.Validate(&http.Request{Header: http.Header{"Authorization": []string{"Bearer " + created.Key}}}); result.Error != ErrAPIKeyRevoked {
+		t.Errorf("expected revoked key to be rejected, got %v", result.Error)
+	}
+	if w := serve(http.MethodPost, "/keys/missing/revoke", "0P5K3Y0123456789", ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected status %d but got %d", http.StatusNotFound, w.Code)
+	}
+	if w := serve(http.MethodPost, "/principals/partner/keys", "0P5K3Y0123456789", `{"scopes": ["has space"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid scope but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// The saved file is reloaded with the revocation.
+	reloaded, err := NewFileKeyStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config := reloaded.KeySet().Config(); len(config.Principals) != 2 || config.Principals[1].Keys[0].Status != KeyStatusRevoked {
+		t.Errorf("expected saved configuration to include the revoked key, got %+v", config.Principals)
+	}
+}
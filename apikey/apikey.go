@@ -3,49 +3,214 @@ package apikey
 import (
 	"errors"
 	"net/http"
-	"strings"
+	"net/netip"
+	"sync/atomic"
+	"time"
 )
 
 var ErrAuthorizationRequired = errors.New("authorization required")
 var ErrInvalidAuthorizationHeader = errors.New("invalid authorization header")
 var ErrInvalidAPIKey = errors.New("invalid API key")
+var ErrAPIKeyRevoked = errors.New("API key has been revoked")
+var ErrAPIKeyExpired = errors.New("API key has expired")
+var ErrAPIKeyNotYetValid = errors.New("API key is not yet valid")
+var ErrClientIPNotAllowed = errors.New("API key is not allowed from this client IP")
+var ErrRouteNotAllowed = errors.New("API key is not allowed for this request")
 
 const bearerPrefix string = "Bearer "
 
+// APIKey validates requests against the keys in Store or, if Store is nil,
+// in Config. Config is compiled on first use and must not be modified in
+// place afterwards; assign a new slice, or use a KeyStore, to change keys. An
+// APIKey must not be copied after first use.
 type APIKey struct {
 	Config []*APIKeyConfig
+	Store  KeyStore
+
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For entries are believed when determining the client IP,
+	// see ClientIP.
+	TrustedProxies []netip.Prefix
+
+	// ErrorWriter writes the responses of rejected requests for the
+	// middleware. WritePlainTextError is used if it is nil.
+	ErrorWriter ErrorWriter
+
+	// Extractors are the locations searched for the API key, in order. The
+	// first key found is used, and a different key in another location is
+	// rejected with ErrConflictingAPIKeys. DefaultExtractors is used if it is
+	// nil.
+	Extractors []KeyExtractor
+
+	// OnValidate callbacks receive the outcome of every validation.
+	OnValidate []OnValidate
+
+	// Signing, if set, also accepts requests signed with HMAC-SHA256, see
+	// SignRequest.
+	Signing *SigningOptions
+
+	// ClientCertificates, if set, also accepts requests without an API key
+	// whose verified TLS client certificate is mapped to a principal, see
+	// CertificateMatch.
+	ClientCertificates bool
+
+	// Tokens, if set, also accepts the access tokens issued by TokenHandler
+	// in place of API keys.
+	Tokens *TokenOptions
+
+	configKeys atomic.Pointer[configKeySet]
 }
 
 type Result struct {
 	Principal  string
+	KeyID      string // ID of the matched key, empty if the key has none
+	Deprecated bool   // the matched key is valid but scheduled for retirement
+	Scopes     []string
+	RateLimit  *RateLimit // limit applying to the principal, nil if unlimited
+	Quota      *Quota     // quota applying to the principal, nil if unlimited
 	StatusCode int
 	Error      error // a nil error indicates the API Key is valid
+
+	accessToken bool // validated from an access token rather than the key itself
 }
 
 func (r Result) IsValid() bool {
 	return r.Error == nil && r.StatusCode == http.StatusOK
 }
 
+// Validate checks the API key of req and reports the outcome to the
+// OnValidate callbacks.
 func (a *APIKey) Validate(req *http.Request) Result {
-	authHeader := req.Header.Get("Authorization")
-	if authHeader == "" {
-		return Result{Error: ErrAuthorizationRequired, StatusCode: http.StatusUnauthorized}
-	}
-	if !strings.HasPrefix(authHeader, bearerPrefix) {
-		return Result{Error: ErrInvalidAuthorizationHeader, StatusCode: http.StatusBadRequest}
-	}
-	apiKey := strings.TrimSpace(strings.TrimPrefix(authHeader, bearerPrefix))
-
-	for _, entry := range a.Config {
-		for _, key := range entry.Keys {
-			if apiKey == key {
-				return Result{
-					Principal:  entry.Principal,
-					StatusCode: http.StatusOK,
-				}
+	result := a.validate(req)
+	outcome := OutcomeSuccess
+	if !result.IsValid() {
+		outcome = OutcomeFailure
+	}
+	a.notify(req, result, outcome)
+	return result
+}
+
+func (a *APIKey) validate(req *http.Request) Result {
+	if a.Signing != nil {
+		if signed, ok := a.validateSigned(req); ok {
+			return signed
+		}
+	}
+
+	apiKey, err := a.extractKey(req)
+	if errors.Is(err, ErrAuthorizationRequired) {
+		if a.ClientCertificates {
+			if result, ok := a.validateCertificate(req); ok {
+				return result
 			}
 		}
+		return Result{Error: err, StatusCode: http.StatusUnauthorized}
+	}
+	if err != nil {
+		return Result{Error: err, StatusCode: http.StatusBadRequest}
+	}
+
+	if a.Tokens != nil && isAccessToken(apiKey) {
+		return a.validateToken(req, apiKey, time.Now())
+	}
+
+	if IsStructuredKey(apiKey) {
+		// A mistyped or truncated key is rejected without a lookup.
+		if _, err := ParseKey(apiKey); err != nil {
+			return Result{Error: ErrMalformedAPIKey, StatusCode: http.StatusUnprocessableEntity}
+		}
+	}
+
+	if match := a.keySet().lookup(apiKey); match != nil {
+		return a.accept(req, match, time.Now())
 	}
 
 	return Result{Error: ErrInvalidAPIKey, StatusCode: http.StatusUnprocessableEntity}
 }
+
+// accept checks the key that matched a request, and the request against the
+// principal's restrictions, and records its use.
+func (a *APIKey) accept(req *http.Request, match *compiledKey, now time.Time) Result {
+	result := checkKey(match, now)
+	if result.IsValid() {
+		if err := a.checkRestrictions(req, match); err != nil {
+			result.Deprecated = false
+			result.StatusCode, result.Error = http.StatusForbidden, err
+		}
+	}
+	if recorder, ok := a.Store.(UsageRecorder); ok && result.IsValid() && result.KeyID != "" {
+		recorder.RecordUsage(result.KeyID, now)
+	}
+	return result
+}
+
+// keySet returns the keys to validate against. The KeySet compiled from
+// Config is cached until Config is replaced.
+func (a *APIKey) keySet() *KeySet {
+	if a.Store != nil {
+		return a.Store.KeySet()
+	}
+	if len(a.Config) == 0 {
+		return NewKeySet(a.Config)
+	}
+	if cached := a.configKeys.Load(); cached != nil && cached.first == &a.Config[0] && cached.len == len(a.Config) {
+		return cached.keySet
+	}
+	ks := NewKeySet(a.Config)
+	a.configKeys.Store(&configKeySet{first: &a.Config[0], len: len(a.Config), keySet: ks})
+	return ks
+}
+
+// configKeySet is the KeySet compiled from an APIKey.Config slice, identified
+// by its first element and length.
+type configKeySet struct {
+	first  **APIKeyConfig
+	len    int
+	keySet *KeySet
+}
+
+// checkKey applies the status and validity window of a key that matched the
+// presented API key. Rejected results still identify the principal and key so
+// that use of a retired key can be traced.
+func checkKey(match *compiledKey, now time.Time) Result {
+	key := match.key
+	result := Result{
+		Principal: match.entry.Principal,
+		KeyID:     key.ID,
+		Scopes:    mergeScopes(match.entry.Scopes, key.Scopes),
+		RateLimit: match.rateLimit,
+		Quota:     match.quota,
+	}
+	switch {
+	case key.Status == KeyStatusRevoked:
+		result.Error, result.StatusCode = ErrAPIKeyRevoked, http.StatusUnauthorized
+	case key.NotBefore != nil && now.Before(*key.NotBefore):
+		result.Error, result.StatusCode = ErrAPIKeyNotYetValid, http.StatusUnauthorized
+	case key.ExpiresAt != nil && !now.Before(*key.ExpiresAt):
+		result.Error, result.StatusCode = ErrAPIKeyExpired, http.StatusUnauthorized
+	default:
+		result.Deprecated = key.Status == KeyStatusDeprecated
+		result.StatusCode = http.StatusOK
+	}
+	return result
+}
+
+// checkRestrictions applies the principal's allowed_cidrs and allowed_routes
+// to a request made with one of its keys.
+func (a *APIKey) checkRestrictions(req *http.Request, match *compiledKey) error {
+	if len(match.entry.AllowedCIDRs) > 0 && !containsIP(match.allowedIPs, a.ClientIP(req)) {
+		return ErrClientIPNotAllowed
+	}
+	if len(match.entry.AllowedRoutes) > 0 {
+		if req.URL == nil {
+			return ErrRouteNotAllowed
+		}
+		for _, route := range match.entry.AllowedRoutes {
+			if matchRoute(route.Method, route.Path, req) {
+				return nil
+			}
+		}
+		return ErrRouteNotAllowed
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package apikey
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,17 +11,18 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 var api = &APIKey{
 	Config: []*APIKeyConfig{
 		{
 			Principal: "dev-team",
-			Keys:      []string{"07H3R73573RK3Y23", "abcdef0123456789"},
+			Keys:      KeyValues("07H3R73573RK3Y23", "abcdef0123456789"),
 		},
 		{
 			Principal: "prod-team",
-			Keys:      []string{"3133773573RK3Y42"},
+			Keys:      KeyValues("3133773573RK3Y42"),
 		},
 	},
 }
@@ -180,6 +182,127 @@ func TestValidate(t *testing.T) {
 	}
 }
 
+func TestValidateHashedKeys(t *testing.T) {
+	structured, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %s", err)
+	}
+	argon2idKey, err := HashKeyArgon2id(structured.String())
+	if err != nil {
+		t.Fatalf("HashKeyArgon2id failed: %s", err)
+	}
+	hashedAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{
+				Principal: "dev-team",
+				Keys:      []Key{{Value: HashKey("07H3R73573RK3Y23")}, {Value: "abcdef0123456789"}},
+			},
+			{
+				Principal: "prod-team",
+				Keys:      []Key{{ID: structured.ID, Value: argon2idKey}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		Name              string
+		Key               string
+		ExpectedPrincipal string
+		ExpectedStatus    int
+	}{
+		{Name: "sha256 key", Key: "07H3R73573RK3Y23", ExpectedPrincipal: "dev-team", ExpectedStatus: http.StatusOK},
+		{Name: "plaintext key alongside digests", Key: "abcdef0123456789", ExpectedPrincipal: "dev-team", ExpectedStatus: http.StatusOK},
+		{Name: "argon2id key", Key: structured.String(), ExpectedPrincipal: "prod-team", ExpectedStatus: http.StatusOK},
+		{Name: "sha256 digest presented as key", Key: HashKey("07H3R73573RK3Y23"), ExpectedStatus: http.StatusUnprocessableEntity},
+		{Name: "argon2id hash presented as key", Key: argon2idKey, ExpectedStatus: http.StatusUnprocessableEntity},
+		{Name: "wrong key", Key: "07H3R73573RK3Y24", ExpectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := &http.Request{
+				Header: http.Header{"Authorization": []string{"Bearer " + testCase.Key}},
+			}
+			result := hashedAPI.Validate(req)
+			if result.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Expected status %d but Validate returned %d", testCase.ExpectedStatus, result.StatusCode)
+			}
+			if result.Principal != testCase.ExpectedPrincipal {
+				t.Errorf("Expected principal %q but got %q", testCase.ExpectedPrincipal, result.Principal)
+			}
+		})
+	}
+}
+
+func TestValidateKeyMetadata(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	metadataAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{
+				Principal: "partner",
+				Keys: []Key{
+					{ID: "current", Value: "CURR3N7K3Y012345", ExpiresAt: &future},
+					{ID: "old", Value: "0LDK3Y0123456789", Status: KeyStatusDeprecated},
+					{ID: "leaked", Value: "L3AK3DK3Y0123456", Status: KeyStatusRevoked},
+					{ID: "expired", Value: "3XP1R3DK3Y012345", ExpiresAt: &past},
+					{ID: "staged", Value: "57AG3DK3Y0123456", NotBefore: &future},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		Name               string
+		Key                string
+		ExpectedKeyID      string
+		ExpectedError      error
+		ExpectedStatus     int
+		ExpectedDeprecated bool
+	}{
+		{Name: "Current key", Key: "CURR3N7K3Y012345", ExpectedKeyID: "current", ExpectedStatus: http.StatusOK},
+		{Name: "Deprecated key", Key: "0LDK3Y0123456789", ExpectedKeyID: "old", ExpectedStatus: http.StatusOK, ExpectedDeprecated: true},
+		{Name: "Revoked key", Key: "L3AK3DK3Y0123456", ExpectedKeyID: "leaked", ExpectedError: ErrAPIKeyRevoked, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Expired key", Key: "3XP1R3DK3Y012345", ExpectedKeyID: "expired", ExpectedError: ErrAPIKeyExpired, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Staged key", Key: "57AG3DK3Y0123456", ExpectedKeyID: "staged", ExpectedError: ErrAPIKeyNotYetValid, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Unknown key", Key: "UNKN0WNK3Y012345", ExpectedError: ErrInvalidAPIKey, ExpectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			req := &http.Request{
+				Header: http.Header{"Authorization": []string{"Bearer " + testCase.Key}},
+			}
+			result := metadataAPI.Validate(req)
+			if result.Error != testCase.ExpectedError {
+				t.Errorf("Expected error %v but got %v", testCase.ExpectedError, result.Error)
+			}
+			if result.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("Expected status %d but Validate returned %d", testCase.ExpectedStatus, result.StatusCode)
+			}
+			if result.KeyID != testCase.ExpectedKeyID {
+				t.Errorf("Expected key ID %q but got %q", testCase.ExpectedKeyID, result.KeyID)
+			}
+			if result.Deprecated != testCase.ExpectedDeprecated {
+				t.Errorf("Expected Deprecated to be %v but got %v", testCase.ExpectedDeprecated, result.Deprecated)
+			}
+		})
+	}
+
+	t.Run("Deprecated key warning header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, testURL, nil)
+		r.Header.Set("Authorization", "Bearer 0LDK3Y0123456789")
+		w := httptest.NewRecorder()
+		metadataAPI.ValidateHandler(http.HandlerFunc(testHandleFunc)).ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status code %d, but got %d", http.StatusOK, w.Code)
+		}
+		if w.Header().Get("Warning") == "" {
+			t.Errorf("Expected a Warning header for a deprecated key")
+		}
+	})
+}
+
 const expectedText string = "It works!"
 const healthText string = "healthy"
 
@@ -287,6 +410,212 @@ func TestNewServeMuxRestricted(t *testing.T) {
 	}
 }
 
+func TestValidateRestrictions(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restrictedAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{
+				Principal:     "partner",
+				Keys:          []Key{{Value: "P4R7N3RK3Y012345"}},
+				AllowedCIDRs:  []string{"203.0.113.0/24", "198.51.100.7"},
+				AllowedRoutes: []AllowedRoute{{Method: http.MethodPost, Path: "/webhooks/partner"}, {Path: "/status/"}},
+			},
+		},
+		TrustedProxies: proxies,
+	}
+
+	testCases := []struct {
+		Name           string
+		Method         string
+		URL            string
+		RemoteAddr     string
+		ForwardedFor   string
+		ExpectedStatus int
+		ExpectedError  error
+	}{
+		{Name: "Allowed", Method: http.MethodPost, URL: "/webhooks/partner", RemoteAddr: "203.0.113.9:4711", ExpectedStatus: http.StatusOK},
+		{Name: "Allowed single host and prefix", Method: http.MethodGet, URL: "/status/jobs/1", RemoteAddr: "198.51.100.7:4711", ExpectedStatus: http.StatusOK},
+		{Name: "Allowed through proxy", Method: http.MethodPost, URL: "/webhooks/partner", RemoteAddr: "10.0.0.2:4711", ForwardedFor: "203.0.113.9", ExpectedStatus: http.StatusOK},
+		{Name: "Client IP not allowed", Method: http.MethodPost, URL: "/webhooks/partner", RemoteAddr: "192.0.2.1:4711", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrClientIPNotAllowed},
+		{Name: "Forwarded IP not trusted", Method: http.MethodPost, URL: "/webhooks/partner", RemoteAddr: "192.0.2.1:4711", ForwardedFor: "203.0.113.9", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrClientIPNotAllowed},
+		{Name: "Wrong method", Method: http.MethodGet, URL: "/webhooks/partner", RemoteAddr: "203.0.113.9:4711", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrRouteNotAllowed},
+		{Name: "Wrong path", Method: http.MethodPost, URL: "/admin", RemoteAddr: "203.0.113.9:4711", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrRouteNotAllowed},
+		{Name: "Path escaping allowed prefix", Method: http.MethodPost, URL: "/webhooks/../admin", RemoteAddr: "203.0.113.9:4711", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrRouteNotAllowed},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(testCase.Method, testCase.URL, nil)
+			r.RemoteAddr = testCase.RemoteAddr
+			r.Header.Set("Authorization", "Bearer P4R7N3RK3Y012345")
+			if testCase.ForwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", testCase.ForwardedFor)
+			}
+			result := restrictedAPI.Validate(r)
+			if result.StatusCode != testCase.ExpectedStatus || result.Error != testCase.ExpectedError {
+				t.Errorf("expected status %d error %v, got status %d error %v", testCase.ExpectedStatus, testCase.ExpectedError, result.StatusCode, result.Error)
+			}
+			if result.Principal != "partner" {
+				t.Errorf("expected out-of-policy use to identify the principal, got %q", result.Principal)
+			}
+		})
+	}
+}
+
+func TestRequireScopes(t *testing.T) {
+	scopedAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{
+				Principal: "reporting",
+				Scopes:    []string{"reports:read"},
+				Keys: []Key{
+					{ID: "reader", Value: "R3AD3RK3Y0123456"},
+					{ID: "writer", Value: "WR173RK3Y0123456", Scopes: []string{"reports:write"}},
+				},
+			},
+		},
+	}
+
+	routes := []RouteScope{
+		{Method: http.MethodPost, Path: "/reports/", Scopes: []string{"reports:write"}},
+		{Path: "/reports/", Scopes: []string{"reports:read"}},
+		{Path: "/admin", Scopes: []string{"admin"}},
+	}
+
+	testCases := []struct {
+		Name           string
+		Method         string
+		URL            string
+		Key            string
+		ExpectedStatus int
+		ExpectedText   string
+	}{
+		{Name: "Read with read scope", Method: http.MethodGet, URL: "/reports/1", Key: "R3AD3RK3Y0123456", ExpectedStatus: http.StatusOK, ExpectedText: expectedText},
+		{Name: "Write without write scope", Method: http.MethodPost, URL: "/reports/1", Key: "R3AD3RK3Y0123456", ExpectedStatus: http.StatusForbidden, ExpectedText: ErrInsufficientScope.Error()},
+		{Name: "Write with key scope", Method: http.MethodPost, URL: "/reports/1", Key: "WR173RK3Y0123456", ExpectedStatus: http.StatusOK, ExpectedText: expectedText},
+		{Name: "Admin without scope", Method: http.MethodGet, URL: "/admin", Key: "WR173RK3Y0123456", ExpectedStatus: http.StatusForbidden, ExpectedText: ErrInsufficientScope.Error()},
+		{Name: "Unlisted route", Method: http.MethodGet, URL: "/status", Key: "R3AD3RK3Y0123456", ExpectedStatus: http.StatusOK, ExpectedText: expectedText},
+		{Name: "Invalid key", Method: http.MethodGet, URL: "/reports/1", Key: "B4DK3Y0123456789", ExpectedStatus: http.StatusUnprocessableEntity, ExpectedText: ErrInvalidAPIKey.Error()},
+	}
+
+	handler := scopedAPI.RequireRouteScopes(http.HandlerFunc(testHandleFunc), routes)
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(testCase.Method, testCase.URL, nil)
+			r.Header.Set("Authorization", "Bearer "+testCase.Key)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != testCase.ExpectedStatus {
+				t.Errorf("Expected status code %d, but got %d", testCase.ExpectedStatus, w.Code)
+			}
+			if bodyText := strings.TrimSpace(w.Body.String()); bodyText != testCase.ExpectedText {
+				t.Errorf("Expected response text to be %q, but got %q", testCase.ExpectedText, bodyText)
+			}
+		})
+	}
+
+	t.Run("RequireScopes", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/reports/1", nil)
+		r.Header.Set("Authorization", "Bearer R3AD3RK3Y0123456")
+		w := httptest.NewRecorder()
+		scopedAPI.RequireScopes(http.HandlerFunc(testHandleFunc), "reports:read", "reports:write").ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code %d, but got %d", http.StatusForbidden, w.Code)
+		}
+	})
+}
+
+func TestResultFromContext(t *testing.T) {
+	var principal, keyID string
+	var scopes []string
+	var found bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, found = PrincipalFromContext(r.Context())
+		keyID, _ = KeyIDFromContext(r.Context())
+		scopes, _ = ScopesFromContext(r.Context())
+	})
+
+	contextAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{
+				Principal: "reporting",
+				Scopes:    []string{"reports:read"},
+				Keys:      []Key{{ID: "reader", Value: "R3AD3RK3Y0123456"}},
+			},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, testURL, nil)
+	r.Header.Set("Authorization", "Bearer R3AD3RK3Y0123456")
+	contextAPI.ValidateHandler(contextAPI.RequireScopes(handler, "reports:read")).ServeHTTP(httptest.NewRecorder(), r)
+	if !found || principal != "reporting" || keyID != "reader" || len(scopes) != 1 || scopes[0] != "reports:read" {
+		t.Errorf("Expected reporting/reader/[reports:read] in context, got found=%v %q/%q/%v", found, principal, keyID, scopes)
+	}
+
+	// A result placed in the context upstream is trusted without validating again.
+	r = httptest.NewRequest(http.MethodGet, testURL, nil)
+	r = r.WithContext(NewContext(r.Context(), Result{Principal: "upstream", StatusCode: http.StatusOK, Scopes: []string{"reports:read"}}))
+	w := httptest.NewRecorder()
+	contextAPI.RequireScopes(handler, "reports:read").ServeHTTP(w, r)
+	if w.Code != http.StatusOK || principal != "upstream" {
+		t.Errorf("Expected upstream result to be reused, got status %d and principal %q", w.Code, principal)
+	}
+
+	if _, ok := PrincipalFromContext(context.Background()); ok {
+		t.Errorf("Expected no principal in an empty context")
+	}
+}
+
+func TestValidateHandlerWithOptions(t *testing.T) {
+	opts := HandlerOptions{
+		PublicPaths:    []string{"/healthz", "/api/health"},
+		PublicPrefixes: []string{"/.well-known/"},
+		PublicRoutes:   []Route{{Method: http.MethodGet, Path: "/metrics"}},
+		IsPublic: func(r *http.Request) bool {
+			return r.Header.Get("X-Internal-Probe") == "1"
+		},
+	}
+
+	testCases := []struct {
+		Name           string
+		Method         string
+		URL            string
+		Header         http.Header
+		ExpectedStatus int
+	}{
+		{Name: "Public path", Method: http.MethodGet, URL: "/healthz", ExpectedStatus: http.StatusOK},
+		{Name: "Public path under prefix", Method: http.MethodGet, URL: "/api/health", ExpectedStatus: http.StatusOK},
+		{Name: "Default health path not public", Method: http.MethodGet, URL: "/health", ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Public prefix", Method: http.MethodGet, URL: "/.well-known/openid-configuration", ExpectedStatus: http.StatusOK},
+		{Name: "Public prefix escaped with dot-dot", Method: http.MethodGet, URL: "/.well-known/../admin", ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Public path with repeated slash", Method: http.MethodGet, URL: "//healthz", ExpectedStatus: http.StatusOK},
+		{Name: "Public path with trailing slash", Method: http.MethodGet, URL: "/healthz/", ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Public route", Method: http.MethodGet, URL: "/metrics", ExpectedStatus: http.StatusOK},
+		{Name: "Public route wrong method", Method: http.MethodPost, URL: "/metrics", ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Custom predicate", Method: http.MethodGet, URL: testURL, Header: http.Header{"X-Internal-Probe": []string{"1"}}, ExpectedStatus: http.StatusOK},
+		{Name: "Restricted path", Method: http.MethodGet, URL: testURL, ExpectedStatus: http.StatusUnauthorized},
+		{Name: "Restricted path with key", Method: http.MethodGet, URL: testURL, Header: http.Header{"Authorization": []string{"Bearer 3133773573RK3Y42"}}, ExpectedStatus: http.StatusOK},
+	}
+
+	handler := api.ValidateHandlerWithOptions(http.HandlerFunc(testHandleFunc), opts)
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(testCase.Method, testCase.URL, nil)
+			for k, v := range testCase.Header {
+				r.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != testCase.ExpectedStatus {
+				t.Errorf("Expected status code %d, but got %d", testCase.ExpectedStatus, w.Code)
+			}
+		})
+	}
+}
+
 func TestLoadConfigFromEnvJSON(t *testing.T) {
 	previousEnvConfig := strings.TrimSpace(os.Getenv(APIKeyEnvVarName))
 	if previousEnvConfig != "" {
@@ -340,6 +669,102 @@ func TestLoadConfigFromEnvJSON(t *testing.T) {
 			ExpectedError: fmt.Sprintf("error parsing %s: invalid character 'k' after object key:value pair", APIKeyEnvVarName),
 			NumErrors:     1,
 		},
+		{
+			Name:   "Valid configuration sha256 digest",
+			Config: `[{"principal": "ia-team","keys": ["sha256:9f1ec4d5e4b4e7d5a5e0b7c1f1c4f7d2b8b8cf93e1ac3a1a0e54a3d6a5d7f0c2"]}]`,
+		},
+		{
+			Name:   "Valid configuration mixed plaintext and digest",
+			Config: `[{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP", "sha256:9f1ec4d5e4b4e7d5a5e0b7c1f1c4f7d2b8b8cf93e1ac3a1a0e54a3d6a5d7f0c2"]}]`,
+		},
+		{
+			Name:   "Valid configuration argon2id hash",
+			Config: `[{"principal": "ia-team","keys": [{"id": "0123456789abcdef", "key": "$argon2id$v=19$m=19456,t=2,p=1$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"}]}]`,
+		},
+		{
+			Name:          "Invalid configuration argon2id hash without id",
+			Config:        `[{"principal": "ia-team","keys": ["$argon2id$v=19$m=19456,t=2,p=1$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"]}]`,
+			ExpectedError: fmt.Sprintf("%s argon2id key must have the id of its structured key for principal ia-team", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration short sha256 digest",
+			Config:        `[{"principal": "ia-team","keys": ["sha256:abcd"]}]`,
+			ExpectedError: fmt.Sprintf("%s key digest is invalid for principal ia-team: invalid sha256 digest length 2, should be 32 bytes", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration malformed argon2id hash",
+			Config:        `[{"principal": "ia-team","keys": ["$argon2id$v=19$m=19456,t=2,p=1$c29tZXNhbHQ"]}]`,
+			ExpectedError: fmt.Sprintf("%s key digest is invalid for principal ia-team: invalid argon2id hash: expected $argon2id$v=<version>$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:   "Valid configuration key metadata",
+			Config: `[{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP", {"id": "2024-rotation", "key": "QRSTUVWXYZABCDEF", "not_before": "2024-01-01T00:00:00Z", "expires_at": "2025-01-01T00:00:00Z", "status": "deprecated"}]}]`,
+		},
+		{
+			Name:          "Invalid configuration key status",
+			Config:        `[{"principal": "ia-team","keys": [{"key": "ABCDEFGHIJKLMNOP", "status": "retired"}]}]`,
+			ExpectedError: fmt.Sprintf("%s key status \"retired\" is invalid for principal ia-team", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration key validity window",
+			Config:        `[{"principal": "ia-team","keys": [{"key": "ABCDEFGHIJKLMNOP", "not_before": "2025-01-01T00:00:00Z", "expires_at": "2024-01-01T00:00:00Z"}]}]`,
+			ExpectedError: fmt.Sprintf("%s key not_before must be before expires_at for principal ia-team", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration duplicate key id",
+			Config:        `[{"principal": "ia-team","keys": [{"id": "k1", "key": "ABCDEFGHIJKLMNOP"}]}, {"principal": "dev-team","keys": [{"id": "k1", "key": "QRSTUVWXYZABCDEF"}]}]`,
+			ExpectedError: fmt.Sprintf("%s key id k1 is used more than once", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:   "Valid configuration scopes",
+			Config: `[{"principal": "ia-team","scopes": ["reports:read"],"keys": [{"key": "ABCDEFGHIJKLMNOP", "scopes": ["reports:write"]}]}]`,
+		},
+		{
+			Name:          "Invalid configuration empty scope",
+			Config:        `[{"principal": "ia-team","scopes": [""],"keys": ["ABCDEFGHIJKLMNOP"]}]`,
+			ExpectedError: fmt.Sprintf("%s scope \"\" is invalid for principal ia-team", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:   "Valid configuration document with default rate limit",
+			Config: `{"default_rate_limit": {"requests_per_second": 10, "burst": 20},"principals": [{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"],"rate_limit": {"requests_per_second": 1}}]}`,
+		},
+		{
+			Name:          "Invalid configuration rate limit",
+			Config:        `[{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"],"rate_limit": {"requests_per_second": 0}}]`,
+			ExpectedError: fmt.Sprintf("%s rate_limit for principal ia-team requests_per_second must be greater than 0", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration default rate limit",
+			Config:        `{"default_rate_limit": {"requests_per_second": 1, "burst": -1},"principals": [{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"]}]}`,
+			ExpectedError: fmt.Sprintf("%s default_rate_limit burst cannot be negative", APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration quota",
+			Config:        `{"default_quota": {"limit": 0, "window": "week"}, "principals": [{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"]}]}`,
+			ExpectedError: fmt.Sprintf(`%s default_quota limit must be greater than 0, %s default_quota window "week" is invalid`, APIKeyEnvVarName, APIKeyEnvVarName),
+			NumErrors:     2,
+		},
+		{
+			Name:          "Invalid configuration allowed CIDR",
+			Config:        `[{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"],"allowed_cidrs": ["203.0.113.0/33"]}]`,
+			ExpectedError: fmt.Sprintf(`%s allowed_cidrs is invalid for principal ia-team: invalid CIDR "203.0.113.0/33": netip.ParsePrefix("203.0.113.0/33"): prefix length out of range`, APIKeyEnvVarName),
+			NumErrors:     1,
+		},
+		{
+			Name:          "Invalid configuration allowed route",
+			Config:        `[{"principal": "ia-team","keys": ["ABCDEFGHIJKLMNOP"],"allowed_routes": [{"method": "POST", "path": "webhooks"}]}]`,
+			ExpectedError: fmt.Sprintf(`%s allowed_routes path "webhooks" must start with / for principal ia-team`, APIKeyEnvVarName),
+			NumErrors:     1,
+		},
 		{
 			Name:          "Invalid configuration short key length and empty key",
 			Config:        `[{"principal": "ia-team","keys": ["ABCDEF", ""]}]`,
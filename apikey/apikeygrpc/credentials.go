@@ -0,0 +1,21 @@
+package apikeygrpc
+
+import "context"
+
+// KeyCredentials attach an API key to outgoing calls as a Bearer token. Use
+// them with grpc.WithPerRPCCredentials or grpc.PerRPCCredentials.
+type KeyCredentials struct {
+	Key string
+
+	// AllowInsecure permits sending the key over a connection without
+	// transport security, e.g. to a sidecar on localhost.
+	AllowInsecure bool
+}
+
+func (c KeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Key}, nil
+}
+
+func (c KeyCredentials) RequireTransportSecurity() bool {
+	return !c.AllowInsecure
+}
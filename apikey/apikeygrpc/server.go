@@ -0,0 +1,162 @@
+// Package apikeygrpc validates the API keys of gRPC calls with an
+// apikey.APIKey, and attaches keys to outgoing calls.
+package apikeygrpc
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/corbaltcode/go-libraries/apikey"
+)
+
+// ServerOptions configure the server interceptors. Methods are identified by
+// their full name, such as "/grpc.health.v1.Health/Check".
+type ServerOptions struct {
+	// PublicMethods are called without an API key.
+	PublicMethods []string
+
+	// Scopes are required for every method that is not public.
+	Scopes []string
+
+	// MethodScopes are required in addition to Scopes for the given methods.
+	MethodScopes map[string][]string
+}
+
+func (o ServerOptions) isPublic(fullMethod string) bool {
+	for _, m := range o.PublicMethods {
+		if m == fullMethod {
+			return true
+		}
+	}
+	return false
+}
+
+func (o ServerOptions) scopes(fullMethod string) []string {
+	extra := o.MethodScopes[fullMethod]
+	if len(extra) == 0 {
+		return o.Scopes
+	}
+	return append(append([]string{}, o.Scopes...), extra...)
+}
+
+// UnaryServerInterceptor rejects calls without a valid API key with
+// codes.Unauthenticated, and calls whose key lacks a required scope or breaks
+// the principal's restrictions with codes.PermissionDenied. The Result of a
+// successful validation is stored in the context passed to the handler, see
+// apikey.ResultFromContext.
+func UnaryServerInterceptor(a *apikey.APIKey, opts ServerOptions) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if opts.isPublic(info.FullMethod) {
+			return handler(ctx, req)
+		}
+		ctx, err := authorize(ctx, a, info.FullMethod, opts.scopes(info.FullMethod))
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor is like UnaryServerInterceptor for streaming calls.
+// The key is validated once, when the stream is opened.
+func StreamServerInterceptor(a *apikey.APIKey, opts ServerOptions) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if opts.isPublic(info.FullMethod) {
+			return handler(srv, ss)
+		}
+		ctx, err := authorize(ss.Context(), a, info.FullMethod, opts.scopes(info.FullMethod))
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream replaces the context of a stream with one carrying the Result.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// authorize validates the call as the HTTP/2 request that carries it, so
+// extractors, allowed_routes and allowed_cidrs apply as they do to HTTP
+// requests. Signed requests are not supported since the body is not
+// available.
+func authorize(ctx context.Context, a *apikey.APIKey, fullMethod string, scopes []string) (context.Context, error) {
+	req, err := newRequest(ctx, fullMethod)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "invalid method %q", fullMethod)
+	}
+	result := a.Authorize(req, scopes...)
+	if !result.IsValid() {
+		log.Printf("API key failed validation for %s: status %d, %s", fullMethod, result.StatusCode, result.Error)
+		return nil, statusError(result)
+	}
+	return apikey.NewContext(ctx, result), nil
+}
+
+// newRequest returns a request with the metadata of the incoming call as its
+// headers, and the address and TLS connection state of the peer, so client
+// certificates can be validated.
+func newRequest(ctx context.Context, fullMethod string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fullMethod, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	md, _ := metadata.FromIncomingContext(ctx)
+	for name, values := range md {
+		// Skip pseudo-headers and binary metadata, which is base64 encoded on
+		// the wire but decoded here.
+		if strings.HasPrefix(name, ":") || strings.HasSuffix(name, "-bin") {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+	if authority := md.Get(":authority"); len(authority) > 0 {
+		req.Host = authority[0]
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			req.RemoteAddr = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			req.TLS = &info.State
+		}
+	}
+	return req, nil
+}
+
+// statusError converts a failed Result to a gRPC status, so that clients
+// retry or back off as they would for the HTTP status.
+func statusError(result apikey.Result) error {
+	var code codes.Code
+	switch {
+	case result.StatusCode == http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case result.StatusCode == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case result.StatusCode == http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case result.StatusCode >= http.StatusInternalServerError:
+		code = codes.Internal
+	default:
+		code = codes.Unauthenticated
+	}
+	return status.Error(code, result.Error.Error())
+}
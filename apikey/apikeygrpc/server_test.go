@@ -0,0 +1,136 @@
+package apikeygrpc
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/corbaltcode/go-libraries/apikey"
+)
+
+const (
+	checkMethod = "/grpc.health.v1.Health/Check"
+	watchMethod = "/grpc.health.v1.Health/Watch"
+)
+
+func TestServerInterceptors(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	config, err := apikey.ParseConfigJSON([]byte(`[
+		{"principal": "reader", "keys": ["R34D3RK3Y0123456"], "scopes": ["health:read"]},
+		{"principal": "watcher", "keys": ["W47CH3RK3Y012345"], "scopes": ["health:read", "health:watch"]},
+		{"principal": "restricted", "keys": ["R357R1C73DK3Y012"], "scopes": ["health:read"], "allowed_routes": [{"path": "/other.Service/"}]}
+	]`), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a := &apikey.APIKey{Store: apikey.NewKeySetFromConfig(config)}
+	var principals []string
+	opts := ServerOptions{Scopes: []string{"health:read"}, MethodScopes: map[string][]string{watchMethod: {"health:watch"}}}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(a, opts), func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			principal, _ := apikey.PrincipalFromContext(ctx)
+			principals = append(principals, principal)
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(StreamServerInterceptor(a, opts)),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+
+	dial := func(key string) healthpb.HealthClient {
+		t.Helper()
+		dialOpts := []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		}
+		if key != "" {
+			dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(KeyCredentials{Key: key, AllowInsecure: true}))
+		}
+		conn, err := grpc.Dial("bufnet", dialOpts...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return healthpb.NewHealthClient(conn)
+	}
+	check := func(key string) codes.Code {
+		_, err := dial(key).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		return status.Code(err)
+	}
+	watch := func(key string) codes.Code {
+		stream, err := dial(key).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		return status.Code(err)
+	}
+
+	tests := []struct {
+		Name         string
+		Call         func(string) codes.Code
+		Key          string
+		ExpectedCode codes.Code
+	}{
+		{Name: "Unary without key", Call: check, ExpectedCode: codes.Unauthenticated},
+		{Name: "Unary with unknown key", Call: check, Key: "UNKN0WNK3Y012345", ExpectedCode: codes.Unauthenticated},
+		{Name: "Unary with valid key", Call: check, Key: "R34D3RK3Y0123456", ExpectedCode: codes.OK},
+		{Name: "Unary outside allowed routes", Call: check, Key: "R357R1C73DK3Y012", ExpectedCode: codes.PermissionDenied},
+		{Name: "Stream without key", Call: watch, ExpectedCode: codes.Unauthenticated},
+		{Name: "Stream lacking method scope", Call: watch, Key: "R34D3RK3Y0123456", ExpectedCode: codes.PermissionDenied},
+		{Name: "Stream with method scope", Call: watch, Key: "W47CH3RK3Y012345", ExpectedCode: codes.OK},
+	}
+	for _, test := range tests {
+		if code := test.Call(test.Key); code != test.ExpectedCode {
+			t.Errorf("%s: expected code %s but got %s", test.Name, test.ExpectedCode, code)
+		}
+	}
+	if len(principals) != 1 || principals[0] != "reader" {
+		t.Errorf("expected handler to see principal reader once, got %v", principals)
+	}
+
+	opts.PublicMethods = []string{checkMethod}
+	server.Stop()
+	lis = bufconn.Listen(1 << 20)
+	server = grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor(a, opts)))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	if code := check(""); code != codes.OK {
+		t.Errorf("expected public method to be called without a key, got %s", code)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		StatusCode   int
+		ExpectedCode codes.Code
+	}{
+		{StatusCode: http.StatusBadRequest, ExpectedCode: codes.InvalidArgument},
+		{StatusCode: http.StatusUnauthorized, ExpectedCode: codes.Unauthenticated},
+		{StatusCode: http.StatusForbidden, ExpectedCode: codes.PermissionDenied},
+		{StatusCode: http.StatusUnprocessableEntity, ExpectedCode: codes.Unauthenticated},
+		{StatusCode: http.StatusTooManyRequests, ExpectedCode: codes.ResourceExhausted},
+		{StatusCode: http.StatusInternalServerError, ExpectedCode: codes.Internal},
+		{StatusCode: http.StatusServiceUnavailable, ExpectedCode: codes.Internal},
+	}
+	for _, test := range tests {
+		err := statusError(apikey.Result{StatusCode: test.StatusCode, Error: errors.New("failed")})
+		if code := status.Code(err); code != test.ExpectedCode {
+			t.Errorf("status %d: expected code %s but got %s", test.StatusCode, test.ExpectedCode, code)
+		}
+	}
+}
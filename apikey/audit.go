@@ -0,0 +1,227 @@
+package apikey
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// ValidateOutcome classifies a ValidateEvent.
+type ValidateOutcome string
+
+const (
+	OutcomeSuccess       ValidateOutcome = "success"        // the key is valid
+	OutcomeFailure       ValidateOutcome = "failure"        // the request has no valid key
+	OutcomeForbidden     ValidateOutcome = "forbidden"      // a valid key lacks a required scope
+	OutcomeRateLimited   ValidateOutcome = "rate_limited"   // a valid key exceeded its rate limit
+	OutcomeQuotaExceeded ValidateOutcome = "quota_exceeded" // a valid key exceeded its quota
+	OutcomeLockedOut     ValidateOutcome = "locked_out"     // the client is locked out, the key was not checked
+)
+
+// ValidateEvent describes the outcome of validating a request's API key.
+type ValidateEvent struct {
+	Principal  string // empty if no configured key matched
+	KeyID      string
+	Outcome    ValidateOutcome
+	StatusCode int
+	Path       string
+	RemoteAddr string // the client IP, see APIKey.ClientIP
+	Error      error  // nil on success
+}
+
+// OnValidate is called synchronously with the outcome of every call to
+// Validate, including those made by the middleware. The middleware reports a
+// further event when it rejects a valid key for lack of scope, rate limit or
+// quota, and one for each request from a locked out client. Because it runs on every
+// request, implementations should keep their work lightweight.
+type OnValidate func(ctx context.Context, event ValidateEvent)
+
+// notify reports the outcome of a request to the OnValidate callbacks.
+func (a *APIKey) notify(r *http.Request, result Result, outcome ValidateOutcome) {
+	if len(a.OnValidate) == 0 {
+		return
+	}
+	remoteAddr := r.RemoteAddr
+	if ip := a.ClientIP(r); ip.IsValid() {
+		remoteAddr = ip.String()
+	}
+	event := ValidateEvent{
+		Principal:  result.Principal,
+		KeyID:      result.KeyID,
+		Outcome:    outcome,
+		StatusCode: result.StatusCode,
+		RemoteAddr: remoteAddr,
+		Error:      result.Error,
+	}
+	if r.URL != nil {
+		event.Path = r.URL.Path
+	}
+	for _, callback := range a.OnValidate {
+		callback(r.Context(), event)
+	}
+}
+
+// LogOnValidate returns an OnValidate callback that logs each outcome to the
+// provided logger, at Info level for successes and Warn level otherwise.
+func LogOnValidate(logger *slog.Logger) OnValidate {
+	return func(ctx context.Context, event ValidateEvent) {
+		attrs := []slog.Attr{
+			slog.String("outcome", string(event.Outcome)),
+			slog.Int("status", event.StatusCode),
+			slog.String("path", event.Path),
+			slog.String("remote_addr", event.RemoteAddr),
+		}
+		if event.Principal != "" {
+			attrs = append(attrs, slog.String("principal", event.Principal))
+		}
+		if event.KeyID != "" {
+			attrs = append(attrs, slog.String("key_id", event.KeyID))
+		}
+		level := slog.LevelInfo
+		if event.Error != nil {
+			level = slog.LevelWarn
+			attrs = append(attrs, slog.String("error", event.Error.Error()))
+		}
+		logger.LogAttrs(ctx, level, "apikey: validated request", attrs...)
+	}
+}
+
+// metricPutter is the part of *cloudwatch.Client used to publish metrics.
+type metricPutter interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// PushCloudWatchOnValidate returns an OnValidate callback that counts events
+// in memory and publishes the count of each Outcome to CloudWatch as
+// APIKeyValidation metrics once a minute from a background goroutine, so
+// requests never wait on CloudWatch. If a PutMetricData call fails, the error
+// is passed to onError and the counts it carried are dropped. If onError is
+// nil, failures are silently ignored.
+//
+// The returned stop function ends the goroutine and publishes the counts
+// recorded since the last flush, using ctx for the final PutMetricData calls.
+// Call it before the service exits; events recorded afterwards are not
+// published.
+func PushCloudWatchOnValidate(client *cloudwatch.Client, namespace string, onError func(error)) (OnValidate, func(ctx context.Context)) {
+	m := newCloudWatchMetrics(client, namespace, false, onError)
+	go m.run(defaultCloudWatchFlushInterval)
+	return m.record, m.stop
+}
+
+// PushCloudWatchPerPrincipalOnValidate is like PushCloudWatchOnValidate, but
+// also publishes the count per Outcome and Principal for events where a key
+// matched. Each principal is then a separate custom metric, billed as such.
+func PushCloudWatchPerPrincipalOnValidate(client *cloudwatch.Client, namespace string, onError func(error)) (OnValidate, func(ctx context.Context)) {
+	m := newCloudWatchMetrics(client, namespace, true, onError)
+	go m.run(defaultCloudWatchFlushInterval)
+	return m.record, m.stop
+}
+
+const (
+	defaultCloudWatchFlushInterval = time.Minute
+	cloudWatchFlushTimeout         = 5 * time.Second
+	maxMetricDataPerRequest        = 20
+)
+
+type cloudWatchCount struct {
+	outcome   ValidateOutcome
+	principal string // empty for the aggregate
+}
+
+type cloudWatchMetrics struct {
+	client       metricPutter
+	namespace    string
+	perPrincipal bool
+	onError      func(error)
+
+	mu     sync.Mutex
+	counts map[cloudWatchCount]float64
+
+	done     chan struct{} // closed by stop
+	stopped  chan struct{} // closed when run returns
+	stopOnce sync.Once
+}
+
+func newCloudWatchMetrics(client metricPutter, namespace string, perPrincipal bool, onError func(error)) *cloudWatchMetrics {
+	return &cloudWatchMetrics{
+		client:       client,
+		namespace:    namespace,
+		perPrincipal: perPrincipal,
+		onError:      onError,
+		counts:       map[cloudWatchCount]float64{},
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+}
+
+func (m *cloudWatchMetrics) record(_ context.Context, event ValidateEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[cloudWatchCount{outcome: event.Outcome}]++
+	if m.perPrincipal && event.Principal != "" {
+		m.counts[cloudWatchCount{outcome: event.Outcome, principal: event.Principal}]++
+	}
+}
+
+func (m *cloudWatchMetrics) run(interval time.Duration) {
+	defer close(m.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), cloudWatchFlushTimeout)
+			m.flush(ctx, time.Now())
+			cancel()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// stop ends run, waiting for a flush in progress, and publishes the
+// remaining counts. Later calls do nothing.
+func (m *cloudWatchMetrics) stop(ctx context.Context) {
+	m.stopOnce.Do(func() {
+		close(m.done)
+		<-m.stopped
+		m.flush(ctx, time.Now())
+	})
+}
+
+// flush publishes the counts recorded since the last flush.
+func (m *cloudWatchMetrics) flush(ctx context.Context, now time.Time) {
+	m.mu.Lock()
+	counts := m.counts
+	m.counts = map[cloudWatchCount]float64{}
+	m.mu.Unlock()
+
+	data := make([]types.MetricDatum, 0, len(counts))
+	for count, value := range counts {
+		dimensions := []types.Dimension{{Name: aws.String("Outcome"), Value: aws.String(string(count.outcome))}}
+		if count.principal != "" {
+			dimensions = append(dimensions, types.Dimension{Name: aws.String("Principal"), Value: aws.String(count.principal)})
+		}
+		data = append(data, types.MetricDatum{
+			MetricName: aws.String("APIKeyValidation"),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(now),
+			Value:      aws.Float64(value),
+			Unit:       types.StandardUnitCount,
+		})
+	}
+	for len(data) > 0 {
+		n := min(len(data), maxMetricDataPerRequest)
+		input := &cloudwatch.PutMetricDataInput{Namespace: aws.String(m.namespace), MetricData: data[:n]}
+		if _, err := m.client.PutMetricData(ctx, input); err != nil && m.onError != nil {
+			m.onError(err)
+		}
+		data = data[n:]
+	}
+}
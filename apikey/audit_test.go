@@ -0,0 +1,174 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+func TestOnValidate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var events []ValidateEvent
+	var logged bytes.Buffer
+	auditAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{Principal: "reader", Keys: []Key{{ID: "reader-1", Value: "R34D3RK3Y0123456"}}, Scopes: []string{"reports:read"}, RateLimit: &RateLimit{RequestsPerSecond: 0.001, Burst: 1}},
+		},
+		OnValidate: []OnValidate{
+			func(_ context.Context, event ValidateEvent) { events = append(events, event) },
+			LogOnValidate(slog.New(slog.NewJSONHandler(&logged, nil))),
+		},
+	}
+	handler := auditAPI.ValidateHandlerWithOptions(
+		auditAPI.RequireRouteScopes(http.HandlerFunc(testHandleFunc), []RouteScope{{Path: "/admin/", Scopes: []string{"admin"}}}),
+		HandlerOptions{RateLimiter: NewMemoryRateLimiter()},
+	)
+
+	steps := []struct {
+		Name     string
+		Path     string
+		Key      string
+		Expected []ValidateEvent
+	}{
+		{
+			Name:     "Unknown key",
+			Path:     testURL,
+			Key:      "UNKN0WNK3Y012345",
+			Expected: []ValidateEvent{{Outcome: OutcomeFailure, StatusCode: http.StatusUnprocessableEntity, Path: testURL, RemoteAddr: "192.0.2.1", Error: ErrInvalidAPIKey}},
+		},
+		{
+			Name:     "Success",
+			Path:     testURL,
+			Key:      "R34D3RK3Y0123456",
+			Expected: []ValidateEvent{{Principal: "reader", KeyID: "reader-1", Outcome: OutcomeSuccess, StatusCode: http.StatusOK, Path: testURL, RemoteAddr: "192.0.2.1"}},
+		},
+		{
+			Name: "Rate limited",
+			Path: testURL,
+			Key:  "R34D3RK3Y0123456",
+			Expected: []ValidateEvent{
+				{Principal: "reader", KeyID: "reader-1", Outcome: OutcomeSuccess, StatusCode: http.StatusOK, Path: testURL, RemoteAddr: "192.0.2.1"},
+				{Principal: "reader", KeyID: "reader-1", Outcome: OutcomeRateLimited, StatusCode: http.StatusTooManyRequests, Path: testURL, RemoteAddr: "192.0.2.1", Error: ErrRateLimitExceeded},
+			},
+		},
+	}
+
+	for _, step := range steps {
+		events = nil
+		r := httptest.NewRequest(http.MethodGet, step.Path, nil)
+		r.Header.Set("Authorization", "Bearer "+step.Key)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if len(events) != len(step.Expected) {
+			t.Errorf("%s: expected %d events but got %v", step.Name, len(step.Expected), events)
+			continue
+		}
+		for i, expected := range step.Expected {
+			if events[i] != expected {
+				t.Errorf("%s: expected event %+v but got %+v", step.Name, expected, events[i])
+			}
+		}
+	}
+
+	// Scope failures are reported once the key has been validated.
+	events = nil
+	scopeHandler := auditAPI.RequireScopes(http.HandlerFunc(testHandleFunc), "admin")
+	r := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+	r.Header.Set("Authorization", "Bearer R34D3RK3Y0123456")
+	scopeHandler.ServeHTTP(httptest.NewRecorder(), r)
+	if len(events) != 2 || events[1].Outcome != OutcomeForbidden || events[1].Error != ErrInsufficientScope || events[1].StatusCode != http.StatusForbidden {
+		t.Errorf("expected success and forbidden events, got %+v", events)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(bytes.SplitN(logged.Bytes(), []byte("\n"), 2)[0], &entry); err != nil {
+		t.Fatalf("invalid log entry %q: %s", logged.String(), err)
+	}
+	if entry["level"] != "WARN" || entry["outcome"] != "failure" || entry["error"] != ErrInvalidAPIKey.Error() || entry["path"] != testURL {
+		t.Errorf("unexpected log entry %v", entry)
+	}
+}
+
+type fakeMetricPutter struct {
+	mu     sync.Mutex
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeMetricPutter) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inputs = append(f.inputs, params)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func TestCloudWatchMetrics(t *testing.T) {
+	putter := &fakeMetricPutter{}
+	metrics := newCloudWatchMetrics(putter, "Test", true, nil)
+	for i := 0; i < 3; i++ {
+		metrics.record(context.Background(), ValidateEvent{Principal: "alpha", Outcome: OutcomeSuccess})
+	}
+	metrics.record(context.Background(), ValidateEvent{Principal: "beta", Outcome: OutcomeSuccess})
+	metrics.record(context.Background(), ValidateEvent{Outcome: OutcomeFailure})
+	metrics.flush(context.Background(), time.Now())
+
+	if len(putter.inputs) != 1 || aws.ToString(putter.inputs[0].Namespace) != "Test" {
+		t.Fatalf("expected one PutMetricData call, got %d", len(putter.inputs))
+	}
+	counts := map[string]float64{}
+	for _, datum := range putter.inputs[0].MetricData {
+		var name string
+		for _, dimension := range datum.Dimensions {
+			name += aws.ToString(dimension.Name) + "=" + aws.ToString(dimension.Value) + " "
+		}
+		counts[strings.TrimSpace(name)] = aws.ToFloat64(datum.Value)
+	}
+	expected := map[string]float64{
+		"Outcome=success":                 4,
+		"Outcome=success Principal=alpha": 3,
+		"Outcome=success Principal=beta":  1,
+		"Outcome=failure":                 1,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected counts %v but got %v", expected, counts)
+	}
+
+	metrics.flush(context.Background(), time.Now())
+	if len(putter.inputs) != 1 {
+		t.Errorf("expected nothing to be published without new events, got %d calls", len(putter.inputs))
+	}
+}
+
+func TestCloudWatchMetricsStop(t *testing.T) {
+	putter := &fakeMetricPutter{}
+	metrics := newCloudWatchMetrics(putter, "Test", false, nil)
+	go metrics.run(time.Hour)
+	metrics.record(context.Background(), ValidateEvent{Principal: "alpha", Outcome: OutcomeSuccess})
+	metrics.record(context.Background(), ValidateEvent{Outcome: OutcomeFailure})
+
+	metrics.stop(context.Background())
+	select {
+	case <-metrics.stopped:
+	default:
+		t.Fatal("expected stop to wait for the background goroutine")
+	}
+	if len(putter.inputs) != 1 || len(putter.inputs[0].MetricData) != 2 {
+		t.Fatalf("expected the last batch to be published on stop, got %v", putter.inputs)
+	}
+
+	metrics.stop(context.Background())
+	if len(putter.inputs) != 1 {
+		t.Errorf("expected a second stop to publish nothing, got %d calls", len(putter.inputs))
+	}
+}
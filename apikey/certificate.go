@@ -0,0 +1,75 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var ErrUnknownClientCertificate = errors.New("client certificate is not mapped to a principal")
+
+// SPKIFingerprint returns the hex encoded SHA-256 digest of the subject public
+// key info of cert, for use as CertificateMatch.SPKISHA256. Unlike a
+// fingerprint of the whole certificate, it survives renewal with the same key.
+func SPKIFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(digest[:])
+}
+
+// index returns the name under which certificates matching m are indexed in
+// a KeySet, checking that exactly one way of matching is given.
+func (m CertificateMatch) index() (string, error) {
+	var names []string
+	if m.CommonName != "" {
+		names = append(names, "common_name "+m.CommonName)
+	}
+	if m.URI != "" {
+		names = append(names, "uri "+m.URI)
+	}
+	if m.SPKISHA256 != "" {
+		digest, err := hex.DecodeString(m.SPKISHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return "", fmt.Errorf("spki_sha256 %q must be %d hex encoded bytes", m.SPKISHA256, sha256.Size)
+		}
+		names = append(names, "spki_sha256 "+strings.ToLower(m.SPKISHA256))
+	}
+	if len(names) != 1 {
+		return "", errors.New("exactly one of common_name, uri and spki_sha256 must be set")
+	}
+	return names[0], nil
+}
+
+// lookupCertificate returns the configured certificate matching cert, trying
+// its public key, then its URIs, then its common name.
+func (ks *KeySet) lookupCertificate(cert *x509.Certificate) *compiledKey {
+	if k, ok := ks.byCertificate["spki_sha256 "+SPKIFingerprint(cert)]; ok {
+		return k
+	}
+	for _, uri := range cert.URIs {
+		if k, ok := ks.byCertificate["uri "+uri.String()]; ok {
+			return k
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return ks.byCertificate["common_name "+cert.Subject.CommonName]
+	}
+	return nil
+}
+
+// validateCertificate validates the verified client certificate of a request
+// that has no API key. It reports false if there is no such certificate.
+func (a *APIKey) validateCertificate(req *http.Request) (Result, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return Result{}, false
+	}
+	match := a.keySet().lookupCertificate(req.TLS.VerifiedChains[0][0])
+	if match == nil {
+		return Result{Error: ErrUnknownClientCertificate, StatusCode: http.StatusUnauthorized}, true
+	}
+	return a.accept(req, match, time.Now()), true
+}
@@ -0,0 +1,162 @@
+package apikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, commonName string, uris ...string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	for _, uri := range uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		template.URIs = append(template.URIs, u)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return cert
+}
+
+func TestValidateClientCertificate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	pinned := newTestCertificate(t, "billing.internal")
+	byURI := newTestCertificate(t, "ignored", "spiffe://example.org/reports")
+	byCommonName := newTestCertificate(t, "batch.internal")
+	unknown := newTestCertificate(t, "unknown.internal")
+
+	config, err := ParseConfigJSON([]byte(fmt.Sprintf(`[
+		{"principal": "billing", "certificates": [{"id": "billing-cert", "spki_sha256": %q, "scopes": ["billing:write"]}]},
+		{"principal": "reports", "scopes": ["reports:read"], "certificates": [{"uri": "spiffe://example.org/reports"}]},
+		{"principal": "batch", "keys": ["B47CHK3Y01234567"], "certificates": [{"common_name": "batch.internal"}], "allowed_routes": [{"path": "/batch/"}]}
+	]`, SPKIFingerprint(pinned))), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	certAPI := &APIKey{Config: config.Principals, ClientCertificates: true}
+
+	tests := []struct {
+		Name              string
+		Certificate       *x509.Certificate
+		Unverified        bool
+		Path              string
+		Key               string
+		ExpectedStatus    int
+		ExpectedError     error
+		ExpectedPrincipal string
+		ExpectedKeyID     string
+		ExpectedScopes    []string
+	}{
+		{Name: "Public key fingerprint", Certificate: pinned, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "billing", ExpectedKeyID: "billing-cert", ExpectedScopes: []string{"billing:write"}},
+		{Name: "URI", Certificate: byURI, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "reports", ExpectedScopes: []string{"reports:read"}},
+		{Name: "Common name", Certificate: byCommonName, Path: "/batch/run", ExpectedStatus: http.StatusOK, ExpectedPrincipal: "batch"},
+		{Name: "Common name outside allowed routes", Certificate: byCommonName, Path: "/reports", ExpectedStatus: http.StatusForbidden, ExpectedError: ErrRouteNotAllowed, ExpectedPrincipal: "batch"},
+		{Name: "Unknown certificate", Certificate: unknown, ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrUnknownClientCertificate},
+		{Name: "Unverified certificate", Certificate: pinned, Unverified: true, ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrAuthorizationRequired},
+		{Name: "API key takes precedence", Certificate: pinned, Path: "/batch/run", Key: "B47CHK3Y01234567", ExpectedStatus: http.StatusOK, ExpectedPrincipal: "batch"},
+		{Name: "No certificate", ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrAuthorizationRequired},
+	}
+	for _, test := range tests {
+		path := test.Path
+		if path == "" {
+			path = "/"
+		}
+		r := httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil)
+		if test.Key != "" {
+			r.Header.Set("Authorization", "Bearer "+test.Key)
+		}
+		if test.Certificate != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.Certificate}}
+			if !test.Unverified {
+				r.TLS.VerifiedChains = [][]*x509.Certificate{{test.Certificate}}
+			}
+		}
+		result := certAPI.Validate(r)
+		if result.StatusCode != test.ExpectedStatus || result.Error != test.ExpectedError {
+			t.Errorf("%s: expected status %d and error %v but got %d and %v", test.Name, test.ExpectedStatus, test.ExpectedError, result.StatusCode, result.Error)
+		}
+		if result.Principal != test.ExpectedPrincipal || result.KeyID != test.ExpectedKeyID {
+			t.Errorf("%s: expected principal %q and key ID %q but got %q and %q", test.Name, test.ExpectedPrincipal, test.ExpectedKeyID, result.Principal, result.KeyID)
+		}
+		if len(test.ExpectedScopes) > 0 && !result.HasScopes(test.ExpectedScopes...) {
+			t.Errorf("%s: expected scopes %v but got %v", test.Name, test.ExpectedScopes, result.Scopes)
+		}
+	}
+
+	withoutCertificates := &APIKey{Config: config.Principals}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{pinned}}}
+	if result := withoutCertificates.Validate(r); result.Error != ErrAuthorizationRequired {
+		t.Errorf("expected certificates to be ignored unless enabled, got %v", result.Error)
+	}
+}
+
+func TestCertificateMatchValidation(t *testing.T) {
+	tests := []struct {
+		Name          string
+		Config        string
+		ExpectedError string
+	}{
+		{
+			Name:          "No way of matching",
+			Config:        `[{"principal": "p", "certificates": [{"id": "c"}]}]`,
+			ExpectedError: "test certificate is invalid for principal p: exactly one of common_name, uri and spki_sha256 must be set",
+		},
+		{
+			Name:          "Two ways of matching",
+			Config:        `[{"principal": "p", "certificates": [{"common_name": "a", "uri": "spiffe://example.org/a"}]}]`,
+			ExpectedError: "test certificate is invalid for principal p: exactly one of common_name, uri and spki_sha256 must be set",
+		},
+		{
+			Name:          "Invalid fingerprint",
+			Config:        `[{"principal": "p", "certificates": [{"spki_sha256": "abcd"}]}]`,
+			ExpectedError: `test certificate is invalid for principal p: spki_sha256 "abcd" must be 32 hex encoded bytes`,
+		},
+		{
+			Name:          "Mapped twice",
+			Config:        `[{"principal": "p", "certificates": [{"common_name": "a"}]}, {"principal": "q", "certificates": [{"common_name": "a"}]}]`,
+			ExpectedError: "test certificate common_name a is mapped more than once",
+		},
+		{
+			Name:          "Neither keys nor certificates",
+			Config:        `[{"principal": "p"}]`,
+			ExpectedError: "test entry keys array cannot be empty for principal p",
+		},
+	}
+	for _, test := range tests {
+		_, err := ParseConfigJSON([]byte(test.Config), "test")
+		if err == nil || err.Error() != test.ExpectedError {
+			t.Errorf("%s: expected error %q but got %v", test.Name, test.ExpectedError, err)
+		}
+	}
+}
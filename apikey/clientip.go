@@ -0,0 +1,101 @@
+package apikey
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses CIDRs such as "10.0.0.0/8" for
+// APIKey.TrustedProxies. A bare address is treated as a single host.
+func ParseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	return parsePrefixes(cidrs)
+}
+
+// parsePrefixes parses CIDRs, treating a bare address as a single host.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsIP reports whether addr is in any of prefixes.
+func containsIP(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent req. The connection's
+// remote address is used unless it belongs to one of the TrustedProxies, in
+// which case X-Forwarded-For is followed from the right, skipping trusted
+// proxies, to the first address that was not added by one of them. The zero
+// Addr is returned if the remote address cannot be parsed.
+func (a *APIKey) ClientIP(req *http.Request) netip.Addr {
+	client := parseIP(req.RemoteAddr)
+	if !client.IsValid() || !a.isTrustedProxy(client) {
+		return client
+	}
+	forwarded := forwardedFor(req.Header)
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := parseIP(forwarded[i])
+		if !addr.IsValid() {
+			// A malformed entry cannot be followed, so the last proxy is the
+			// best known client.
+			break
+		}
+		client = addr
+		if !a.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
+
+func (a *APIKey) isTrustedProxy(addr netip.Addr) bool {
+	return containsIP(a.TrustedProxies, addr)
+}
+
+// forwardedFor returns the entries of all X-Forwarded-For headers in order.
+func forwardedFor(header http.Header) []string {
+	var entries []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
+
+// parseIP parses an address with or without a port, as found in
+// http.Request.RemoteAddr and X-Forwarded-For.
+func parseIP(s string) netip.Addr {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
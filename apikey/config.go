@@ -1,18 +1,111 @@
 package apikey
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 const APIKeyEnvVarName string = "API_KEY_CONFIG"
 
 type APIKeyConfig struct {
-	Principal string   `json:"principal"`
-	Keys      []string `json:"keys"`
+	Principal string     `json:"principal"`
+	Keys      []Key      `json:"keys"`
+	Scopes    []string   `json:"scopes,omitempty"`     // granted to every key of the principal
+	RateLimit *RateLimit `json:"rate_limit,omitempty"` // enforced by ValidateHandlerWithOptions, see RateLimiter
+	Quota     *Quota     `json:"quota,omitempty"`      // enforced by ValidateHandlerWithOptions, see QuotaCounter
+
+	// AllowedCIDRs, if set, restrict use of the principal's keys to client
+	// IPs in these networks, see APIKey.ClientIP.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
+	// AllowedRoutes, if set, restrict use of the principal's keys to
+	// requests matching one of these routes.
+	AllowedRoutes []AllowedRoute `json:"allowed_routes,omitempty"`
+
+	// Certificates map verified TLS client certificates to the principal,
+	// see APIKey.ClientCertificates.
+	Certificates []CertificateMatch `json:"certificates,omitempty"`
+}
+
+// AllowedRoute matches requests by method and path like RouteScope.
+type AllowedRoute struct {
+	Method string `json:"method,omitempty"` // empty matches any method
+	Path   string `json:"path"`             // exact path, or a path prefix when it ends in "/"
+}
+
+// CertificateMatch identifies client certificates by exactly one of their
+// subject common name, a URI subject alternative name such as a SPIFFE ID, or
+// the SHA-256 fingerprint of their subject public key info.
+type CertificateMatch struct {
+	ID         string   `json:"id,omitempty"` // reported as Result.KeyID, unique with the key IDs
+	CommonName string   `json:"common_name,omitempty"`
+	URI        string   `json:"uri,omitempty"`
+	SPKISHA256 string   `json:"spki_sha256,omitempty"` // hex encoded, see SPKIFingerprint
+	Scopes     []string `json:"scopes,omitempty"`      // granted in addition to the principal's scopes
+}
+
+// Config is a complete configuration document. In JSON it may be an object
+// with the fields below or, as originally supported, just the array of
+// principals.
+type Config struct {
+	DefaultRateLimit *RateLimit      `json:"default_rate_limit,omitempty"` // applies to principals without a rate_limit
+	DefaultQuota     *Quota          `json:"default_quota,omitempty"`      // applies to principals without a quota
+	Principals       []*APIKeyConfig `json:"principals"`
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		*c = Config{}
+		return json.Unmarshal(trimmed, &c.Principals)
+	}
+	type config Config // avoid recursing into this method
+	return json.Unmarshal(data, (*config)(c))
+}
+
+type KeyStatus string
+
+const (
+	KeyStatusActive     KeyStatus = "active"
+	KeyStatusDeprecated KeyStatus = "deprecated" // still accepted, but flagged so callers rotate
+	KeyStatusRevoked    KeyStatus = "revoked"
+)
+
+// Key is a single API key belonging to a principal. In JSON it may be given
+// either as a bare string holding the key (or its digest) or as an object
+// carrying the key along with its metadata.
+type Key struct {
+	ID        string     `json:"id,omitempty"`
+	Value     string     `json:"key"` // plaintext key or digest, see HashKey
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Status    KeyStatus  `json:"status,omitempty"` // empty is equivalent to KeyStatusActive
+	Scopes    []string   `json:"scopes,omitempty"` // granted in addition to the principal's scopes
+}
+
+// KeyValues returns keys without metadata holding values, which may be
+// plaintext keys or digests. It eases building configs in code, where Keys
+// was a []string before keys carried metadata:
+//
+//	Keys: apikey.KeyValues(key1, key2)
+func KeyValues(values ...string) []Key {
+	keys := make([]Key, len(values))
+	for i, value := range values {
+		keys[i] = Key{Value: value}
+	}
+	return keys
+}
+
+func (k *Key) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '"' {
+		*k = Key{}
+		return json.Unmarshal(trimmed, &k.Value)
+	}
+	type key Key // avoid recursing into this method
+	return json.Unmarshal(data, (*key)(k))
 }
 
 type ConfigErrors struct {
@@ -39,45 +132,180 @@ func (ce ConfigErrors) Error() string {
 
 // GetConfigFromEnvJSON returns []*APIKeyConfig and ConfigErrors. In addition to satisfying the
 // error interface, ConfigErrors has helper methods which provides the logging individual errors
-// or returning the slice of errors for hands-on processing.
+// or returning the slice of errors for hands-on processing. Settings outside the principals
+// array, such as default_rate_limit and default_quota, are only available through NewEnvKeyStore.
 func GetConfigFromEnvJSON() ([]*APIKeyConfig, error) {
-	config := []*APIKeyConfig{}
-	var configErrors ConfigErrors
-
 	envConfig := strings.TrimSpace(os.Getenv(APIKeyEnvVarName))
 	if envConfig == "" {
-		configErrors.errs = append(configErrors.errs, fmt.Errorf("environment variable %s must be set", APIKeyEnvVarName))
-		return nil, configErrors
+		return nil, ConfigErrors{errs: []error{fmt.Errorf("environment variable %s must be set", APIKeyEnvVarName)}}
 	}
 
-	err := json.Unmarshal([]byte(envConfig), &config)
+	config, err := ParseConfigJSON([]byte(envConfig), APIKeyEnvVarName)
 	if err != nil {
-		configErrors.errs = append(configErrors.errs, fmt.Errorf("error parsing %s: %s", APIKeyEnvVarName, err))
+		return nil, err
+	}
+	return config.Principals, nil
+}
+
+// ParseConfigJSON parses and validates a JSON configuration document. The
+// source names where the document came from (an environment variable, file,
+// etc.) and prefixes each error. Like GetConfigFromEnvJSON, the returned error
+// is of type ConfigErrors.
+func ParseConfigJSON(data []byte, source string) (*Config, error) {
+	config := &Config{}
+	var configErrors ConfigErrors
+
+	err := json.Unmarshal(data, config)
+	if err != nil {
+		configErrors.errs = append(configErrors.errs, fmt.Errorf("error parsing %s: %s", source, err))
 		return nil, configErrors
 	}
+	if err := validateConfig(config, source); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
 
-	for _, entry := range config {
+// validateConfig applies the rules of ParseConfigJSON to a configuration
+// from any source, returning ConfigErrors if it is invalid.
+func validateConfig(config *Config, source string) error {
+	var configErrors ConfigErrors
+	if config.DefaultRateLimit != nil {
+		configErrors.errs = append(configErrors.errs, validateRateLimit(source, config.DefaultRateLimit, "default_rate_limit")...)
+	}
+	if config.DefaultQuota != nil {
+		configErrors.errs = append(configErrors.errs, validateQuota(source, config.DefaultQuota, "default_quota")...)
+	}
+	keyIDs := map[string]struct{}{}
+	certificates := map[string]struct{}{}
+	for _, entry := range config.Principals {
 		if strings.TrimSpace(entry.Principal) == "" {
-			configErrors.errs = append(configErrors.errs, fmt.Errorf("%s entry principal string cannot be empty", APIKeyEnvVarName))
+			configErrors.errs = append(configErrors.errs, fmt.Errorf("%s entry principal string cannot be empty", source))
+		}
+		if len(entry.Keys) == 0 && len(entry.Certificates) == 0 {
+			configErrors.errs = append(configErrors.errs, fmt.Errorf("%s entry keys array cannot be empty for principal %s", source, entry.Principal))
+		}
+		configErrors.errs = append(configErrors.errs, validateScopes(source, entry.Scopes, entry.Principal)...)
+		if entry.RateLimit != nil {
+			configErrors.errs = append(configErrors.errs, validateRateLimit(source, entry.RateLimit, "rate_limit for principal "+entry.Principal)...)
 		}
-		if len(entry.Keys) == 0 {
-			configErrors.errs = append(configErrors.errs, fmt.Errorf("%s entry keys array cannot be empty for principal %s", APIKeyEnvVarName, entry.Principal))
+		if entry.Quota != nil {
+			configErrors.errs = append(configErrors.errs, validateQuota(source, entry.Quota, "quota for principal "+entry.Principal)...)
 		}
+		if _, err := parsePrefixes(entry.AllowedCIDRs); err != nil {
+			configErrors.errs = append(configErrors.errs, fmt.Errorf("%s allowed_cidrs is invalid for principal %s: %s", source, entry.Principal, err))
+		}
+		for _, route := range entry.AllowedRoutes {
+			if !strings.HasPrefix(route.Path, "/") {
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s allowed_routes path %q must start with / for principal %s", source, route.Path, entry.Principal))
+			}
+		}
+		for _, cert := range entry.Certificates {
+			configErrors.errs = append(configErrors.errs, validateScopes(source, cert.Scopes, entry.Principal)...)
+			if cert.ID != "" {
+				if _, ok := keyIDs[cert.ID]; ok {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key id %s is used more than once", source, cert.ID))
+				}
+				keyIDs[cert.ID] = struct{}{}
+			}
+			match, err := cert.index()
+			if err != nil {
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s certificate is invalid for principal %s: %s", source, entry.Principal, err))
+				continue
+			}
+			if _, ok := certificates[match]; ok {
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s certificate %s is mapped more than once", source, match))
+			}
+			certificates[match] = struct{}{}
+		}
+		plaintextKeys := 0
 		for _, key := range entry.Keys {
-			k := strings.TrimSpace(key)
+			configErrors.errs = append(configErrors.errs, validateScopes(source, key.Scopes, entry.Principal)...)
+			if key.ID != "" {
+				if _, ok := keyIDs[key.ID]; ok {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key id %s is used more than once", source, key.ID))
+				}
+				keyIDs[key.ID] = struct{}{}
+			}
+			switch key.Status {
+			case "", KeyStatusActive, KeyStatusDeprecated, KeyStatusRevoked:
+			default:
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key status %q is invalid for principal %s", source, key.Status, entry.Principal))
+			}
+			if key.NotBefore != nil && key.ExpiresAt != nil && !key.NotBefore.Before(*key.ExpiresAt) {
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key not_before must be before expires_at for principal %s", source, entry.Principal))
+			}
+
+			k := strings.TrimSpace(key.Value)
 			if k == "" {
-				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key string cannot be empty for principal %s", APIKeyEnvVarName, entry.Principal))
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key string cannot be empty for principal %s", source, entry.Principal))
 				continue
 			}
-			if len(k) < 16 {
-				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key string length cannot be less that 16 characters for principal %s", APIKeyEnvVarName, entry.Principal))
+			if IsHashedKey(k) {
+				stored, err := parseStoredKey(k)
+				if err != nil {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key digest is invalid for principal %s: %s", source, entry.Principal, err))
+				} else if stored.scheme == schemeArgon2id && key.ID == "" {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s argon2id key must have the id of its structured key for principal %s", source, entry.Principal))
+				}
+				continue
+			}
+			if IsStructuredKey(k) {
+				structured, err := ParseKey(k)
+				if err != nil {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key is not a valid structured key for principal %s: %s", source, entry.Principal, err))
+					continue
+				}
+				if key.ID != "" && key.ID != structured.ID {
+					configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key id %s does not match the id embedded in its key for principal %s", source, key.ID, entry.Principal))
+				}
+			} else if len(k) < 16 {
+				configErrors.errs = append(configErrors.errs, fmt.Errorf("%s key string length cannot be less that 16 characters for principal %s", source, entry.Principal))
+				continue
 			}
+			plaintextKeys++
+		}
+		if plaintextKeys > 0 {
+			log.Printf("warning: %s has %d plaintext key(s) for principal %s; replace them with digests from apikey.HashKey", source, plaintextKeys, entry.Principal)
 		}
 	}
 
 	if len(configErrors.errs) > 0 {
-		return nil, configErrors
+		return configErrors
 	}
+	return nil
+}
 
-	return config, nil
+func validateScopes(source string, scopes []string, principal string) []error {
+	var errs []error
+	for _, scope := range scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n") {
+			errs = append(errs, fmt.Errorf("%s scope %q is invalid for principal %s", source, scope, principal))
+		}
+	}
+	return errs
+}
+
+func validateRateLimit(source string, limit *RateLimit, name string) []error {
+	var errs []error
+	if limit.RequestsPerSecond <= 0 {
+		errs = append(errs, fmt.Errorf("%s %s requests_per_second must be greater than 0", source, name))
+	}
+	if limit.Burst < 0 {
+		errs = append(errs, fmt.Errorf("%s %s burst cannot be negative", source, name))
+	}
+	return errs
+}
+
+func validateQuota(source string, quota *Quota, name string) []error {
+	var errs []error
+	if quota.Limit <= 0 {
+		errs = append(errs, fmt.Errorf("%s %s limit must be greater than 0", source, name))
+	}
+	switch quota.Window {
+	case "", QuotaWindowHour, QuotaWindowDay, QuotaWindowMonth:
+	default:
+		errs = append(errs, fmt.Errorf("%s %s window %q is invalid", source, name, quota.Window))
+	}
+	return errs
 }
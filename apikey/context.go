@@ -0,0 +1,39 @@
+package apikey
+
+import "context"
+
+type contextKey int
+
+const resultContextKey contextKey = iota
+
+// NewContext returns a copy of ctx carrying the validation result. The
+// middleware in this package stores valid results this way so that
+// downstream handlers can identify the caller without validating again.
+func NewContext(ctx context.Context, result Result) context.Context {
+	return context.WithValue(ctx, resultContextKey, result)
+}
+
+// ResultFromContext returns the validation result stored in ctx, if any.
+func ResultFromContext(ctx context.Context) (Result, bool) {
+	result, ok := ctx.Value(resultContextKey).(Result)
+	return result, ok
+}
+
+// PrincipalFromContext returns the authenticated principal stored in ctx, if any.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	result, ok := ResultFromContext(ctx)
+	return result.Principal, ok
+}
+
+// KeyIDFromContext returns the ID of the key that authenticated the request,
+// if any. The ID is empty when the matched key has none.
+func KeyIDFromContext(ctx context.Context) (string, bool) {
+	result, ok := ResultFromContext(ctx)
+	return result.KeyID, ok
+}
+
+// ScopesFromContext returns the scopes granted to the authenticated key, if any.
+func ScopesFromContext(ctx context.Context) ([]string, bool) {
+	result, ok := ResultFromContext(ctx)
+	return result.Scopes, ok
+}
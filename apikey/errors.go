@@ -0,0 +1,105 @@
+package apikey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// An ErrorWriter writes the response for a request rejected by the
+// middleware with the given status code and error. Headers such as
+// Retry-After are set before it is called.
+type ErrorWriter func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// WritePlainTextError is the default ErrorWriter, writing the error message
+// as a text/plain body with the status code unchanged.
+func WritePlainTextError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// NewBearerErrorWriter returns an ErrorWriter for OAuth 2.0 clients. Failures
+// to authenticate are answered as described by RFC 6750, with a
+// WWW-Authenticate: Bearer challenge naming realm (omitted if empty) and the
+// error code, and with an unknown key reported as 401 invalid_token rather
+// than 422. The body of every response is an application/problem+json
+// Problem.
+func NewBearerErrorWriter(realm string) ErrorWriter {
+	return func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		status, code := bearerError(status, err)
+		if status == http.StatusUnauthorized || code != "" {
+			w.Header().Set("WWW-Authenticate", bearerChallenge(realm, code, err))
+		}
+		WriteProblem(w, Problem{
+			Type:   "about:blank",
+			Title:  http.StatusText(status),
+			Status: status,
+			Detail: err.Error(),
+		})
+	}
+}
+
+// WriteProblem writes problem as an application/problem+json response with
+// its status code.
+func WriteProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// bearerError maps a middleware error to the status code and RFC 6750 error
+// code of a Bearer challenge. Missing credentials have no error code, and
+// errors unrelated to authentication, such as rate limits, have neither a
+// code nor a new status.
+func bearerError(status int, err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrAuthorizationRequired):
+		return http.StatusUnauthorized, ""
+	case errors.Is(err, ErrInvalidAuthorizationHeader), errors.Is(err, ErrConflictingAPIKeys):
+		return http.StatusBadRequest, "invalid_request"
+	case errors.Is(err, ErrInvalidAPIKey),
+		errors.Is(err, ErrMalformedAPIKey),
+		errors.Is(err, ErrInvalidSignature),
+		errors.Is(err, ErrSignatureExpired),
+		errors.Is(err, ErrReplayedRequest),
+		errors.Is(err, ErrAPIKeyRevoked),
+		errors.Is(err, ErrAPIKeyExpired),
+		errors.Is(err, ErrAPIKeyNotYetValid),
+		errors.Is(err, ErrInvalidAccessToken),
+		errors.Is(err, ErrAccessTokenExpired):
+		return http.StatusUnauthorized, "invalid_token"
+	case errors.Is(err, ErrInsufficientScope):
+		return http.StatusForbidden, "insufficient_scope"
+	}
+	return status, ""
+}
+
+func bearerChallenge(realm, code string, err error) string {
+	challenge := "Bearer"
+	sep := " "
+	if realm != "" {
+		challenge += fmt.Sprintf("%srealm=%q", sep, realm)
+		sep = ", "
+	}
+	if code != "" {
+		challenge += fmt.Sprintf("%serror=%q, error_description=%q", sep, code, err.Error())
+	}
+	return challenge
+}
+
+func (a *APIKey) writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if a.ErrorWriter != nil {
+		a.ErrorWriter(w, r, status, err)
+		return
+	}
+	WritePlainTextError(w, r, status, err)
+}
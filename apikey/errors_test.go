@@ -0,0 +1,80 @@
+package apikey
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerErrorWriter(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	bearerAPI := &APIKey{Config: api.Config, ErrorWriter: NewBearerErrorWriter("reports")}
+	handler := bearerAPI.ValidateHandler(bearerAPI.RequireScopes(http.HandlerFunc(testHandleFunc), "reports:admin"))
+
+	testCases := []struct {
+		Name              string
+		Authorization     string
+		ExpectedStatus    int
+		ExpectedChallenge string
+		ExpectedDetail    string
+	}{
+		{
+			Name:              "Missing credentials",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedChallenge: `Bearer realm="reports"`,
+			ExpectedDetail:    ErrAuthorizationRequired.Error(),
+		},
+		{
+			Name:              "Malformed header",
+			Authorization:     "Basic dXNlcjpwYXNz",
+			ExpectedStatus:    http.StatusBadRequest,
+			ExpectedChallenge: `Bearer realm="reports", error="invalid_request", error_description="invalid authorization header"`,
+			ExpectedDetail:    ErrInvalidAuthorizationHeader.Error(),
+		},
+		{
+			Name:              "Unknown key",
+			Authorization:     "Bearer W40N6K3Y01234567",
+			ExpectedStatus:    http.StatusUnauthorized,
+			ExpectedChallenge: `Bearer realm="reports", error="invalid_token", error_description="invalid API key"`,
+			ExpectedDetail:    ErrInvalidAPIKey.Error(),
+		},
+		{
+			Name:              "Insufficient scope",
+			Authorization:     "Bearer " + api.Config[0].Keys[0].Value,
+			ExpectedStatus:    http.StatusForbidden,
+			ExpectedChallenge: `Bearer realm="reports", error="insufficient_scope", error_description="API key lacks the scope required for this request"`,
+			ExpectedDetail:    ErrInsufficientScope.Error(),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, testURL, nil)
+			if testCase.Authorization != "" {
+				r.Header.Set("Authorization", testCase.Authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != testCase.ExpectedStatus {
+				t.Errorf("expected status %d but got %d", testCase.ExpectedStatus, w.Code)
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != testCase.ExpectedChallenge {
+				t.Errorf("expected WWW-Authenticate %q but got %q", testCase.ExpectedChallenge, challenge)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("expected problem+json content type but got %q", contentType)
+			}
+			var problem Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("invalid problem body %q: %s", w.Body.String(), err)
+			}
+			if problem.Status != testCase.ExpectedStatus || problem.Title != http.StatusText(testCase.ExpectedStatus) || problem.Detail != testCase.ExpectedDetail {
+				t.Errorf("unexpected problem %+v", problem)
+			}
+		})
+	}
+}
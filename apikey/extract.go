@@ -0,0 +1,137 @@
+package apikey
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var ErrConflictingAPIKeys = errors.New("request contains conflicting API keys")
+
+// A KeyExtractor finds an API key in one location of a request. found is
+// false if the location is absent; a present but empty location is found and
+// fails validation as an invalid key. An error such as
+// ErrInvalidAuthorizationHeader rejects a malformed location.
+type KeyExtractor interface {
+	Extract(req *http.Request) (key string, found bool, err error)
+}
+
+// DefaultExtractors returns the extractors used when APIKey.Extractors is
+// nil, which only accept an Authorization: Bearer header.
+func DefaultExtractors() []KeyExtractor {
+	return []KeyExtractor{BearerExtractor{}}
+}
+
+// BearerExtractor reads the key from an Authorization: Bearer header. Any
+// other Authorization scheme is rejected with ErrInvalidAuthorizationHeader.
+type BearerExtractor struct{}
+
+func (BearerExtractor) Extract(req *http.Request) (string, bool, error) {
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", false, nil
+	}
+	if !strings.HasPrefix(authHeader, bearerPrefix) {
+		return "", false, ErrInvalidAuthorizationHeader
+	}
+	return strings.TrimSpace(strings.TrimPrefix(authHeader, bearerPrefix)), true, nil
+}
+
+// HeaderExtractor is the name of a header holding the bare key, such as
+// "X-API-Key".
+type HeaderExtractor string
+
+func (h HeaderExtractor) Extract(req *http.Request) (string, bool, error) {
+	values := req.Header.Values(string(h))
+	if len(values) == 0 {
+		return "", false, nil
+	}
+	return strings.TrimSpace(values[0]), true, nil
+}
+
+// QueryExtractor is the name of a query parameter holding the key, such as
+// "api_key". The middleware removes the parameter from the URL of requests it
+// passes on, so the key does not end up in access logs written downstream.
+type QueryExtractor string
+
+func (q QueryExtractor) Extract(req *http.Request) (string, bool, error) {
+	if req.URL == nil {
+		return "", false, nil
+	}
+	query := req.URL.Query()
+	if !query.Has(string(q)) {
+		return "", false, nil
+	}
+	return strings.TrimSpace(query.Get(string(q))), true, nil
+}
+
+// CookieExtractor is the name of a cookie holding the key.
+type CookieExtractor string
+
+func (c CookieExtractor) Extract(req *http.Request) (string, bool, error) {
+	cookie, err := req.Cookie(string(c))
+	if err != nil {
+		return "", false, nil
+	}
+	return strings.TrimSpace(cookie.Value), true, nil
+}
+
+func (a *APIKey) extractors() []KeyExtractor {
+	if a.Extractors != nil {
+		return a.Extractors
+	}
+	return DefaultExtractors()
+}
+
+// extractKey runs every extractor in order and returns the first key found.
+// The request is rejected if an extractor fails or finds a different key, so
+// a client cannot present one key to this package and another to code that
+// reads a different location.
+func (a *APIKey) extractKey(req *http.Request) (string, error) {
+	var apiKey string
+	anyFound := false
+	for _, extractor := range a.extractors() {
+		key, found, err := extractor.Extract(req)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			continue
+		}
+		if anyFound && key != apiKey {
+			return "", ErrConflictingAPIKeys
+		}
+		apiKey, anyFound = key, true
+	}
+	if !anyFound {
+		return "", ErrAuthorizationRequired
+	}
+	return apiKey, nil
+}
+
+// stripQueryKeys returns req with the parameters read by QueryExtractors
+// removed from its URL. req itself is not modified.
+func (a *APIKey) stripQueryKeys(req *http.Request) *http.Request {
+	if req.URL == nil {
+		return req
+	}
+	query := req.URL.Query()
+	stripped := false
+	for _, extractor := range a.extractors() {
+		if q, ok := extractor.(QueryExtractor); ok && query.Has(string(q)) {
+			query.Del(string(q))
+			stripped = true
+		}
+	}
+	if !stripped {
+		return req
+	}
+	req = req.WithContext(req.Context())
+	u := *req.URL
+	u.RawQuery = query.Encode()
+	req.URL = &u
+	if req.RequestURI != "" {
+		req.RequestURI = u.RequestURI()
+	}
+	return req
+}
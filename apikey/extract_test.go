@@ -0,0 +1,102 @@
+package apikey
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractors(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	extractorAPI := &APIKey{
+		Config:     api.Config,
+		Extractors: []KeyExtractor{BearerExtractor{}, HeaderExtractor("X-API-Key"), QueryExtractor("api_key"), CookieExtractor("api_key")},
+	}
+
+	testCases := []struct {
+		Name              string
+		URL               string
+		Header            http.Header
+		ExpectedStatus    int
+		ExpectedPrincipal string
+		ExpectedError     error
+	}{
+		{Name: "No key", URL: testURL, ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrAuthorizationRequired},
+		{Name: "Bearer header", URL: testURL, Header: http.Header{"Authorization": []string{"Bearer 3133773573RK3Y42"}}, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "prod-team"},
+		{Name: "Named header", URL: testURL, Header: http.Header{"X-Api-Key": []string{"3133773573RK3Y42"}}, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "prod-team"},
+		{Name: "Query parameter", URL: testURL + "?api_key=07H3R73573RK3Y23&page=2", ExpectedStatus: http.StatusOK, ExpectedPrincipal: "dev-team"},
+		{Name: "Cookie", URL: testURL, Header: http.Header{"Cookie": []string{"api_key=07H3R73573RK3Y23"}}, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "dev-team"},
+		{Name: "Same key twice", URL: testURL + "?api_key=3133773573RK3Y42", Header: http.Header{"X-Api-Key": []string{"3133773573RK3Y42"}}, ExpectedStatus: http.StatusOK, ExpectedPrincipal: "prod-team"},
+		{
+			Name:           "Conflicting keys",
+			URL:            testURL + "?api_key=07H3R73573RK3Y23",
+			Header:         http.Header{"Authorization": []string{"Bearer 3133773573RK3Y42"}},
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedError:  ErrConflictingAPIKeys,
+		},
+		{Name: "Empty named header", URL: testURL, Header: http.Header{"X-Api-Key": []string{""}}, ExpectedStatus: http.StatusUnprocessableEntity, ExpectedError: ErrInvalidAPIKey},
+		{
+			Name:           "Malformed Authorization with valid named header",
+			URL:            testURL,
+			Header:         http.Header{"Authorization": []string{"Basic dXNlcjpwYXNz"}, "X-Api-Key": []string{"3133773573RK3Y42"}},
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedError:  ErrInvalidAuthorizationHeader,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, testCase.URL, nil)
+			for k, v := range testCase.Header {
+				r.Header[k] = v
+			}
+			result := extractorAPI.Validate(r)
+			if result.StatusCode != testCase.ExpectedStatus {
+				t.Errorf("expected status %d but got %d", testCase.ExpectedStatus, result.StatusCode)
+			}
+			if result.Principal != testCase.ExpectedPrincipal {
+				t.Errorf("expected principal %q but got %q", testCase.ExpectedPrincipal, result.Principal)
+			}
+			if result.Error != testCase.ExpectedError {
+				t.Errorf("expected error %v but got %v", testCase.ExpectedError, result.Error)
+			}
+		})
+	}
+}
+
+func TestQueryKeyStripped(t *testing.T) {
+	extractorAPI := &APIKey{Config: api.Config, Extractors: []KeyExtractor{QueryExtractor("api_key")}}
+	var seen *http.Request
+	handler := extractorAPI.ValidateHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, testURL+"?api_key=07H3R73573RK3Y23&page=2", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if seen == nil {
+		t.Fatalf("expected request to reach the handler")
+	}
+	if seen.URL.String() != testURL+"?page=2" || seen.RequestURI != testURL+"?page=2" {
+		t.Errorf("expected key to be stripped from the URL, got %q and %q", seen.URL, seen.RequestURI)
+	}
+	if r.URL.RawQuery != "api_key=07H3R73573RK3Y23&page=2" {
+		t.Errorf("expected original request to be unchanged, got %q", r.URL.RawQuery)
+	}
+	if principal, _ := PrincipalFromContext(seen.Context()); principal != "dev-team" {
+		t.Errorf("expected principal dev-team in context, got %q", principal)
+	}
+}
+
+func TestQueryExtractorWithoutURL(t *testing.T) {
+	extractorAPI := &APIKey{Config: api.Config, Extractors: []KeyExtractor{BearerExtractor{}, QueryExtractor("api_key")}}
+	r := &http.Request{Header: http.Header{"Authorization": []string{"Bearer 07H3R73573RK3Y23"}}}
+	result := extractorAPI.Validate(r)
+	if !result.IsValid() || result.Principal != "dev-team" {
+		t.Fatalf("expected request without a URL to be valid, got status %d error %v", result.StatusCode, result.Error)
+	}
+	if stripped := extractorAPI.WithResult(httptest.NewRecorder(), r, result); stripped.URL != nil {
+		t.Errorf("expected URL to stay nil, got %v", stripped.URL)
+	}
+}
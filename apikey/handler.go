@@ -1,20 +1,150 @@
 package apikey
 
 import (
-	"log"
 	"net/http"
+	"path"
+	"strings"
 )
 
+const deprecatedKeyWarning = `299 - "API key is deprecated; rotate to a new key"`
+
+// Route identifies requests by method and exact path.
+type Route struct {
+	Method string
+	Path   string
+}
+
+// HandlerOptions configure ValidateHandlerWithOptions. A request is public,
+// and passed through without an API key, when it matches any of the public
+// paths, prefixes or routes, or when IsPublic returns true. Paths are matched
+// after resolving "." and ".." elements and repeated slashes.
+type HandlerOptions struct {
+	PublicPaths    []string                 // exact paths such as "/health"
+	PublicPrefixes []string                 // path prefixes such as "/.well-known/"
+	PublicRoutes   []Route                  // method and exact path pairs
+	IsPublic       func(*http.Request) bool // optional custom predicate
+
+	// RateLimiter, if set, enforces the rate limit configured for each
+	// principal on requests with a valid API key.
+	RateLimiter RateLimiter
+
+	// QuotaCounter, if set, enforces the quota configured for each principal
+	// on requests that are within their rate limit.
+	QuotaCounter QuotaCounter
+
+	// FailureTracker, if set, counts requests with an unknown API key per
+	// client IP, see APIKey.ClientIP, and rejects clients it has locked out.
+	FailureTracker *FailureTracker
+}
+
+// DefaultHandlerOptions returns the options used by ValidateHandler, which
+// leave only /health public.
+func DefaultHandlerOptions() HandlerOptions {
+	return HandlerOptions{PublicPaths: []string{"/health"}}
+}
+
+func (o HandlerOptions) isPublic(r *http.Request) bool {
+	path := cleanPath(r.URL.Path)
+	for _, p := range o.PublicPaths {
+		if path == p {
+			return true
+		}
+	}
+	for _, prefix := range o.PublicPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, route := range o.PublicRoutes {
+		if r.Method == route.Method && path == route.Path {
+			return true
+		}
+	}
+	return o.IsPublic != nil && o.IsPublic(r)
+}
+
+// cleanPath returns the canonical form of p, as http.ServeMux and most routers
+// resolve it, so that paths such as /.well-known/../admin are matched as the
+// route they reach. A trailing slash is kept.
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// ValidateHandler is an http.Handler that rejects requests without a valid API
+// key, except for /health. The Result of a successful validation is stored in
+// the request context, see ResultFromContext.
 func (a *APIKey) ValidateHandler(h http.Handler) http.Handler {
+	return a.ValidateHandlerWithOptions(h, DefaultHandlerOptions())
+}
+
+// ValidateHandlerWithOptions is like ValidateHandler, but requests considered
+// public by opts are passed through without validation. The zero HandlerOptions
+// validate every request.
+func (a *APIKey) ValidateHandlerWithOptions(h http.Handler, opts HandlerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/health" {
-			result := a.Validate(r)
-			if !result.IsValid() {
-				log.Printf("API key failed validation: status %d, %s", result.StatusCode, result.Error)
-				http.Error(w, result.Error.Error(), result.StatusCode)
+		if !opts.isPublic(r) {
+			var ok bool
+			if opts.FailureTracker != nil {
+				r, ok = a.authenticateTracked(w, r, opts.FailureTracker)
+			} else {
+				r, ok = a.authorize(w, r, nil)
+			}
+			if !ok {
+				return
+			}
+			if err := a.Allow(w, r, opts); err != nil {
+				a.writeError(w, r, http.StatusTooManyRequests, err)
 				return
 			}
 		}
 		h.ServeHTTP(w, r)
 	})
 }
+
+// Allow applies the RateLimiter and QuotaCounter of opts to r, whose Result
+// is in its context, as ValidateHandlerWithOptions does. It sets the
+// RateLimit-* and Quota-* headers on w and returns ErrRateLimitExceeded or
+// ErrQuotaExceeded, with a Retry-After header, if the request should be
+// rejected with 429 Too Many Requests. Use it with WithResult when calling
+// Validate from other middleware.
+func (a *APIKey) Allow(w http.ResponseWriter, r *http.Request, opts HandlerOptions) error {
+	if opts.RateLimiter != nil {
+		if err := a.allowRate(w, r, opts.RateLimiter); err != nil {
+			return err
+		}
+	}
+	if opts.QuotaCounter != nil {
+		if err := a.allowQuota(w, r, opts.QuotaCounter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// authenticateTracked is like authorize without scopes, but rejects clients
+// locked out by tracker and records failed attempts with it.
+func (a *APIKey) authenticateTracked(w http.ResponseWriter, r *http.Request, tracker *FailureTracker) (*http.Request, bool) {
+	ip := a.ClientIP(r)
+	if a.rejectLockedOut(w, r, tracker, ip) {
+		return nil, false
+	}
+	r, result := a.authenticate(w, r)
+	if !result.IsValid() {
+		if isGuess(result) {
+			tracker.Fail(r.Context(), ip)
+		}
+		a.rejectInvalid(w, r, result)
+		return nil, false
+	}
+	return r, true
+}
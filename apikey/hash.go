@@ -0,0 +1,161 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Keys in the configuration may be stored in plaintext (deprecated) or as a
+// digest identified by its scheme prefix:
+//
+//	sha256:<hex digest>
+//	$argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+//
+// The argon2id form is the PHC string format produced by HashKeyArgon2id.
+const (
+	sha256Prefix   = "sha256:"
+	argon2idPrefix = "$argon2id$"
+)
+
+// Default argon2id parameters used by HashKeyArgon2id. Validation recomputes
+// the hash for every request, so these follow the OWASP minimums rather than
+// the heavier settings appropriate for user passwords.
+const (
+	argon2idMemory      uint32 = 19 * 1024
+	argon2idIterations  uint32 = 2
+	argon2idParallelism uint8  = 1
+	argon2idSaltLength         = 16
+	argon2idKeyLength          = 32
+)
+
+type keyScheme int
+
+const (
+	schemePlaintext keyScheme = iota
+	schemeSHA256
+	schemeArgon2id
+)
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	hash        []byte
+}
+
+// storedKey is a configured key decoded into a form that can be compared
+// against a presented key in constant time.
+type storedKey struct {
+	scheme   keyScheme
+	digest   []byte // SHA-256 digest for plaintext and sha256 keys
+	argon2id *argon2idHash
+}
+
+// HashKey returns the sha256-prefixed digest of key for use in the
+// configuration in place of the plaintext key.
+func HashKey(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return sha256Prefix + hex.EncodeToString(digest[:])
+}
+
+// HashKeyArgon2id returns the argon2id PHC string for key using a random salt.
+func HashKeyArgon2id(key string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to read random salt: %w", err)
+	}
+	hash := argon2.IDKey([]byte(key), salt, argon2idIterations, argon2idMemory, argon2idParallelism, argon2idKeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, argon2idMemory, argon2idIterations, argon2idParallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// IsHashedKey reports whether a configured key carries a digest scheme prefix.
+func IsHashedKey(key string) bool {
+	return strings.HasPrefix(key, sha256Prefix) || strings.HasPrefix(key, argon2idPrefix)
+}
+
+func parseStoredKey(key string) (storedKey, error) {
+	switch {
+	case strings.HasPrefix(key, sha256Prefix):
+		digest, err := hex.DecodeString(strings.TrimPrefix(key, sha256Prefix))
+		if err != nil {
+			return storedKey{}, fmt.Errorf("invalid sha256 digest: %w", err)
+		}
+		if len(digest) != sha256.Size {
+			return storedKey{}, fmt.Errorf("invalid sha256 digest length %d, should be %d bytes", len(digest), sha256.Size)
+		}
+		return storedKey{scheme: schemeSHA256, digest: digest}, nil
+	case strings.HasPrefix(key, argon2idPrefix):
+		hash, err := parseArgon2id(key)
+		if err != nil {
+			return storedKey{}, err
+		}
+		return storedKey{scheme: schemeArgon2id, argon2id: hash}, nil
+	default:
+		digest := sha256.Sum256([]byte(key))
+		return storedKey{scheme: schemePlaintext, digest: digest[:]}, nil
+	}
+}
+
+func parseArgon2id(key string) (*argon2idHash, error) {
+	// "$argon2id$v=19$m=...,t=...,p=...$salt$hash" splits into 6 parts with a leading empty string
+	parts := strings.Split(key, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2id hash: expected $argon2id$v=<version>$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+	if h.memory == 0 || h.iterations == 0 || h.parallelism == 0 {
+		return nil, errors.New("invalid argon2id parameters: memory, iterations and parallelism must be positive")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if h.hash, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if len(h.hash) == 0 {
+		return nil, errors.New("invalid argon2id hash: hash cannot be empty")
+	}
+
+	return h, nil
+}
+
+// matches reports whether the presented key, whose SHA-256 digest has already
+// been computed by the caller, corresponds to the stored key. Comparisons are
+// constant time with respect to the key contents.
+func (k storedKey) matches(presented string, presentedDigest [sha256.Size]byte) bool {
+	switch k.scheme {
+	case schemePlaintext, schemeSHA256:
+		return subtle.ConstantTimeCompare(k.digest, presentedDigest[:]) == 1
+	case schemeArgon2id:
+		h := k.argon2id
+		computed := argon2.IDKey([]byte(presented), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.hash)))
+		return subtle.ConstantTimeCompare(h.hash, computed) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+var ErrMalformedAPIKey = errors.New("malformed API key")
+
+// Structured keys have the form
+//
+//	corb_<id>_<secret>_<crc>
+//
+// where id is 12 lowercase hex characters naming the key, secret is 52
+// lowercase base32 characters (256 random bits) and crc is the CRC-32 (IEEE)
+// of everything before the final underscore as 8 lowercase hex characters.
+// The prefix makes leaked keys easy to find in logs and code, and the
+// checksum lets typos be rejected without a lookup.
+const (
+	KeyPrefix = "corb_"
+
+	keyIDBytes      = 6
+	keySecretBytes  = 32
+	keyIDLength     = 2 * keyIDBytes
+	keySecretLength = (keySecretBytes*8 + 4) / 5
+	keyCRCLength    = 8
+)
+
+var keySecretEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// StructuredKey is a parsed structured API key.
+type StructuredKey struct {
+	ID     string
+	Secret string
+}
+
+// GenerateKey returns a new structured key with a random ID and secret.
+func GenerateKey() (StructuredKey, error) {
+	b := make([]byte, keyIDBytes+keySecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return StructuredKey{}, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return StructuredKey{
+		ID:     fmt.Sprintf("%x", b[:keyIDBytes]),
+		Secret: keySecretEncoding.EncodeToString(b[keyIDBytes:]),
+	}, nil
+}
+
+// String returns the key with its prefix and checksum, as presented by clients.
+func (k StructuredKey) String() string {
+	body := KeyPrefix + k.ID + "_" + k.Secret
+	return fmt.Sprintf("%s_%08x", body, crc32.ChecksumIEEE([]byte(body)))
+}
+
+// IsStructuredKey reports whether key has the structured key prefix. It does
+// not check that the rest of the key is well formed, see ParseKey.
+func IsStructuredKey(key string) bool {
+	return strings.HasPrefix(key, KeyPrefix)
+}
+
+// ParseKey parses a structured key, returning an error wrapping
+// ErrMalformedAPIKey if it is not well formed or its checksum does not match.
+func ParseKey(key string) (StructuredKey, error) {
+	if !IsStructuredKey(key) {
+		return StructuredKey{}, fmt.Errorf("%w: missing %s prefix", ErrMalformedAPIKey, KeyPrefix)
+	}
+	parts := strings.Split(strings.TrimPrefix(key, KeyPrefix), "_")
+	if len(parts) != 3 {
+		return StructuredKey{}, fmt.Errorf("%w: expected %sid_secret_crc", ErrMalformedAPIKey, KeyPrefix)
+	}
+	k := StructuredKey{ID: parts[0], Secret: parts[1]}
+	if len(k.ID) != keyIDLength || !isLowerHex(k.ID) {
+		return StructuredKey{}, fmt.Errorf("%w: invalid key id", ErrMalformedAPIKey)
+	}
+	if len(k.Secret) != keySecretLength {
+		return StructuredKey{}, fmt.Errorf("%w: invalid secret length", ErrMalformedAPIKey)
+	}
+	if _, err := keySecretEncoding.DecodeString(k.Secret); err != nil {
+		return StructuredKey{}, fmt.Errorf("%w: invalid secret encoding", ErrMalformedAPIKey)
+	}
+	if len(parts[2]) != keyCRCLength || k.String() != key {
+		return StructuredKey{}, fmt.Errorf("%w: checksum mismatch", ErrMalformedAPIKey)
+	}
+	return k, nil
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
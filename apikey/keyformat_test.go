@@ -0,0 +1,72 @@
+package apikey
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStructuredKeys(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	parsed, err := ParseKey(key.String())
+	if err != nil {
+		t.Fatalf("unexpected error parsing generated key %s: %s", key, err)
+	}
+	if parsed != key {
+		t.Errorf("expected %+v but parsed %+v", key, parsed)
+	}
+
+	// Flip one character of the secret, keeping it valid base32.
+	secret := []byte(key.Secret)
+	if secret[0] == 'a' {
+		secret[0] = 'b'
+	} else {
+		secret[0] = 'a'
+	}
+	typo := fmt.Sprintf("%s%s_%s_%s", KeyPrefix, key.ID, secret, key.String()[len(key.String())-keyCRCLength:])
+
+	malformed := map[string]string{
+		"Typo":             typo,
+		"Truncated":        key.String()[:len(key.String())-1],
+		"Missing part":     KeyPrefix + key.ID + "_" + key.Secret,
+		"Uppercase id":     strings.Replace(key.String(), key.ID, strings.ToUpper(key.ID)+"G", 1),
+		"Invalid encoding": strings.Replace(key.String(), key.Secret, strings.Repeat("1", keySecretLength), 1),
+	}
+	for name, value := range malformed {
+		if _, err := ParseKey(value); !errors.Is(err, ErrMalformedAPIKey) {
+			t.Errorf("%s: expected ErrMalformedAPIKey but got %v", name, err)
+		}
+	}
+
+	config, err := ParseConfigJSON([]byte(fmt.Sprintf(`[{"principal": "structured-team", "keys": [{"id": %q, "key": %q}]}]`, key.ID, HashKey(key.String()))), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	structuredAPI := &APIKey{Store: NewKeySetFromConfig(config)}
+	validate := func(value string) Result {
+		return structuredAPI.Validate(&http.Request{Header: http.Header{"Authorization": []string{"Bearer " + value}}})
+	}
+	if result := validate(key.String()); !result.IsValid() || result.KeyID != key.ID {
+		t.Errorf("expected structured key to be valid, got status %d key id %q", result.StatusCode, result.KeyID)
+	}
+	if result := validate(typo); result.Error != ErrMalformedAPIKey || result.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected mistyped key to be malformed, got status %d error %v", result.StatusCode, result.Error)
+	}
+
+	_, err = ParseConfigJSON([]byte(fmt.Sprintf(`[{"principal": "structured-team", "keys": [{"id": "000000000000", "key": %q}]}]`, key.String())), "test")
+	if expected := "test key id 000000000000 does not match the id embedded in its key for principal structured-team"; err == nil || err.Error() != expected {
+		t.Errorf("expected error %q but got %v", expected, err)
+	}
+	_, err = ParseConfigJSON([]byte(fmt.Sprintf(`[{"principal": "structured-team", "keys": [%q]}]`, typo)), "test")
+	if err == nil || !strings.Contains(err.Error(), "is not a valid structured key") {
+		t.Errorf("expected invalid structured key error but got %v", err)
+	}
+}
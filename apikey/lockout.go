@@ -0,0 +1,201 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrTooManyFailedAttempts = errors.New("too many failed API key attempts")
+
+const (
+	defaultMaxFailures     = 10
+	defaultFailureWindow   = time.Minute
+	defaultLockoutDuration = 15 * time.Minute
+
+	// ipv6LockoutBits is the prefix length by which IPv6 clients are tracked.
+	// A single host is commonly assigned a whole /64, so tracking exact
+	// addresses would let it rotate through addresses to keep guessing.
+	ipv6LockoutBits = 64
+)
+
+// LockoutEvent describes a client IP that has been blocked by a
+// FailureTracker.
+type LockoutEvent struct {
+	ClientIP     netip.Addr
+	ClientPrefix netip.Prefix // the blocked addresses: ClientIP itself, or its /64 for IPv6
+	Failures     int          // failed attempts within the window that triggered the lockout
+	Until        time.Time    // the end of the lockout
+}
+
+// OnLockout is called synchronously by the middleware when a lockout starts.
+type OnLockout func(ctx context.Context, event LockoutEvent)
+
+// FailureTracker counts requests presenting an unknown API key per client IP
+// and blocks clients that make MaxFailures such requests within Window for
+// LockoutDuration, so keys cannot be guessed online. IPv6 clients are counted
+// and blocked by their /64 prefix, since a single host often has all of its
+// addresses. Counts are kept in memory, so each instance of a service tracks
+// its clients separately.
+type FailureTracker struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	onLockout   []OnLockout
+
+	mu        sync.Mutex
+	clients   map[netip.Prefix]*failureRecord
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type failureRecord struct {
+	failures    int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// NewFailureTracker returns a FailureTracker that locks out a client IP for
+// lockout after maxFailures failed attempts within window. Zero values default
+// to 10 failures within a minute and a 15 minute lockout.
+func NewFailureTracker(maxFailures int, window, lockout time.Duration, onLockout ...OnLockout) *FailureTracker {
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxFailures
+	}
+	if window <= 0 {
+		window = defaultFailureWindow
+	}
+	if lockout <= 0 {
+		lockout = defaultLockoutDuration
+	}
+	return &FailureTracker{
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+		onLockout:   onLockout,
+		clients:     map[netip.Prefix]*failureRecord{},
+		now:         time.Now,
+	}
+}
+
+// LockedOut reports whether ip is locked out and, if so, until when.
+func (t *FailureTracker) LockedOut(ip netip.Addr) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if record, ok := t.clients[clientPrefix(ip)]; ok && t.now().Before(record.lockedUntil) {
+		return record.lockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// Fail records a failed attempt from ip, starting a lockout and calling the
+// OnLockout callbacks when it reaches the threshold.
+func (t *FailureTracker) Fail(ctx context.Context, ip netip.Addr) {
+	t.mu.Lock()
+	now := t.now()
+	if now.Sub(t.lastPrune) >= t.window {
+		t.prune(now)
+	}
+	prefix := clientPrefix(ip)
+	record, ok := t.clients[prefix]
+	if !ok || now.Sub(record.windowStart) >= t.window {
+		record = &failureRecord{windowStart: now}
+		t.clients[prefix] = record
+	}
+	record.failures++
+	if record.failures < t.maxFailures || now.Before(record.lockedUntil) {
+		t.mu.Unlock()
+		return
+	}
+	record.lockedUntil = now.Add(t.lockout)
+	event := LockoutEvent{ClientIP: ip, ClientPrefix: prefix, Failures: record.failures, Until: record.lockedUntil}
+	// A new window starts with the lockout, so failures made while blocked
+	// do not extend it.
+	record.failures, record.windowStart = 0, record.lockedUntil
+	t.mu.Unlock()
+
+	for _, callback := range t.onLockout {
+		callback(ctx, event)
+	}
+}
+
+// prune drops clients whose window and lockout have both ended.
+func (t *FailureTracker) prune(now time.Time) {
+	for prefix, record := range t.clients {
+		if now.Sub(record.windowStart) >= t.window && !now.Before(record.lockedUntil) {
+			delete(t.clients, prefix)
+		}
+	}
+	t.lastPrune = now
+}
+
+// clientPrefix returns the addresses tracked together with ip: ip itself for
+// IPv4, and its /64 for IPv6.
+func clientPrefix(ip netip.Addr) netip.Prefix {
+	ip = ip.Unmap()
+	if ip.Is6() {
+		prefix, _ := ip.Prefix(ipv6LockoutBits)
+		return prefix
+	}
+	return netip.PrefixFrom(ip, ip.BitLen())
+}
+
+// isGuess reports whether a failed Result could come from guessing keys, as
+// opposed to a known key that is revoked, expired or lacking a scope.
+func isGuess(result Result) bool {
+	return errors.Is(result.Error, ErrInvalidAPIKey) ||
+		errors.Is(result.Error, ErrMalformedAPIKey) ||
+		errors.Is(result.Error, ErrInvalidSignature) ||
+		errors.Is(result.Error, ErrInvalidAccessToken)
+}
+
+// ValidateTracked is like Validate, but rejects clients locked out by tracker
+// with 429 Too Many Requests and ErrTooManyFailedAttempts, as
+// ValidateHandlerWithOptions does, and records failed attempts with tracker.
+// Use it with Allow when calling Validate from other middleware; the lockout
+// ends at the time reported by tracker.LockedOut.
+func (a *APIKey) ValidateTracked(r *http.Request, tracker *FailureTracker) Result {
+	ip := a.ClientIP(r)
+	if _, locked := tracker.LockedOut(ip); locked {
+		return a.lockedOut(r, ip)
+	}
+	result := a.Validate(r)
+	if !result.IsValid() && isGuess(result) {
+		tracker.Fail(r.Context(), ip)
+	}
+	return result
+}
+
+// rejectLockedOut writes a 429 response with Retry-After if the client is
+// locked out.
+func (a *APIKey) rejectLockedOut(w http.ResponseWriter, r *http.Request, tracker *FailureTracker, ip netip.Addr) bool {
+	until, locked := tracker.LockedOut(ip)
+	if !locked {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(until.Sub(tracker.now()))))
+	result := a.lockedOut(r, ip)
+	a.writeError(w, r, result.StatusCode, result.Error)
+	return true
+}
+
+// lockedOut logs and reports a request from a locked out client.
+func (a *APIKey) lockedOut(r *http.Request, ip netip.Addr) Result {
+	log.Printf("API key request from locked out client %s rejected", ip)
+	result := Result{StatusCode: http.StatusTooManyRequests, Error: ErrTooManyFailedAttempts}
+	a.notify(r, result, OutcomeLockedOut)
+	return result
+}
+
+// LogOnLockout returns an OnLockout callback that logs each lockout to the
+// provided logger.
+func LogOnLockout(logger *log.Logger) OnLockout {
+	return func(_ context.Context, event LockoutEvent) {
+		logger.Printf("apikey: locked out %s until %s after %d failed attempts", event.ClientPrefix, event.Until.Format(time.RFC3339), event.Failures)
+	}
+}
@@ -0,0 +1,114 @@
+package apikey
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	api := &APIKey{TrustedProxies: proxies}
+
+	testCases := []struct {
+		Name         string
+		RemoteAddr   string
+		ForwardedFor []string
+		ExpectedIP   string
+	}{
+		{Name: "Direct client", RemoteAddr: "203.0.113.7:4711", ExpectedIP: "203.0.113.7"},
+		{Name: "Untrusted peer ignores header", RemoteAddr: "203.0.113.7:4711", ForwardedFor: []string{"198.51.100.1"}, ExpectedIP: "203.0.113.7"},
+		{Name: "Trusted proxy", RemoteAddr: "10.1.2.3:4711", ForwardedFor: []string{"198.51.100.1"}, ExpectedIP: "198.51.100.1"},
+		{Name: "Spoofed entries left of the client", RemoteAddr: "10.1.2.3:4711", ForwardedFor: []string{"1.2.3.4, 198.51.100.1, 10.9.9.9"}, ExpectedIP: "198.51.100.1"},
+		{Name: "Multiple headers", RemoteAddr: "192.0.2.1:4711", ForwardedFor: []string{"198.51.100.1", "10.9.9.9"}, ExpectedIP: "198.51.100.1"},
+		{Name: "Only proxies", RemoteAddr: "10.1.2.3:4711", ForwardedFor: []string{"10.9.9.9"}, ExpectedIP: "10.9.9.9"},
+		{Name: "Malformed entry", RemoteAddr: "10.1.2.3:4711", ForwardedFor: []string{"198.51.100.1, unknown"}, ExpectedIP: "10.1.2.3"},
+		{Name: "IPv6", RemoteAddr: "[2001:db8::1]:4711", ExpectedIP: "2001:db8::1"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, testURL, nil)
+			r.RemoteAddr = testCase.RemoteAddr
+			for _, value := range testCase.ForwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if ip := api.ClientIP(r); ip != netip.MustParseAddr(testCase.ExpectedIP) {
+				t.Errorf("expected client IP %s but got %s", testCase.ExpectedIP, ip)
+			}
+		})
+	}
+
+	if _, err := ParseTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("expected error for invalid CIDR")
+	}
+}
+
+func TestValidateHandlerLockout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var events []LockoutEvent
+	tracker := NewFailureTracker(3, time.Minute, time.Minute, func(_ context.Context, event LockoutEvent) {
+		events = append(events, event)
+	})
+	now := time.Unix(1700000000, 0)
+	tracker.now = func() time.Time { return now }
+	handler := api.ValidateHandlerWithOptions(http.HandlerFunc(testHandleFunc), HandlerOptions{FailureTracker: tracker})
+
+	serve := func(remoteAddr, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, testURL, nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := serve("203.0.113.7:4711", "W40N6K3Y01234567"); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("attempt %d: expected status %d but got %d", i, http.StatusUnprocessableEntity, w.Code)
+		}
+	}
+	if len(events) != 1 || events[0].ClientIP != netip.MustParseAddr("203.0.113.7") || events[0].Failures != 3 {
+		t.Fatalf("expected one lockout event for 203.0.113.7, got %v", events)
+	}
+
+	// The valid key is rejected too while the client is locked out.
+	w := serve("203.0.113.7:4711", api.Config[0].Keys[0].Value)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected locked out client to get 429 with Retry-After 60, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := serve("198.51.100.1:4711", api.Config[0].Keys[0].Value); w.Code != http.StatusOK {
+		t.Errorf("expected other client to pass, got %d", w.Code)
+	}
+
+	now = now.Add(time.Minute)
+	if w := serve("203.0.113.7:4711", api.Config[0].Keys[0].Value); w.Code != http.StatusOK {
+		t.Errorf("expected client to pass after the lockout, got %d", w.Code)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected no further lockout events, got %v", events)
+	}
+
+	// IPv6 clients are locked out by /64, so rotating addresses does not help.
+	for i := 1; i <= 3; i++ {
+		serve(fmt.Sprintf("[2001:db8:0:1::%d]:4711", i), "W40N6K3Y01234567")
+	}
+	if len(events) != 2 || events[1].ClientPrefix != netip.MustParsePrefix("2001:db8:0:1::/64") {
+		t.Fatalf("expected a lockout event for 2001:db8:0:1::/64, got %v", events)
+	}
+	if w := serve("[2001:db8:0:1::ffff]:4711", api.Config[0].Keys[0].Value); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected another address in the /64 to be locked out, got %d", w.Code)
+	}
+	if w := serve("[2001:db8:0:2::1]:4711", api.Config[0].Keys[0].Value); w.Code != http.StatusOK {
+		t.Errorf("expected a client in another /64 to pass, got %d", w.Code)
+	}
+}
@@ -0,0 +1,478 @@
+package apikey
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+
+	"github.com/corbaltcode/go-libraries/migrations"
+	"github.com/corbaltcode/go-libraries/pgutils"
+)
+
+var ErrKeyNotFound = errors.New("API key not found")
+
+// PostgresKeyChannel is the notification channel on which changes to the
+// api_keys table are announced by the trigger created by Migrations.
+const PostgresKeyChannel = "api_keys_changed"
+
+const (
+	defaultPostgresRefreshInterval = 5 * time.Minute
+	defaultUsageFlushInterval      = 30 * time.Second
+)
+
+// Migrations create the api_keys table used by PostgresKeyStore. Append them
+// to the service's own migrations; do not reorder or edit them. key_hash holds
+// a digest as produced by HashKey or HashKeyArgon2id, never a plaintext key.
+//
+// A trigger notifies PostgresKeyChannel whenever keys are added, removed or
+// changed other than by last_used_at updates, so revoking a key with plain SQL
+// takes effect immediately in every PostgresKeyStore.
+var Migrations = []migrations.NamedMigration{
+	{
+		Name: "Create api_keys table",
+		Migration: migrations.StaticMigration([]string{
+			`CREATE TABLE api_keys (
+				id TEXT PRIMARY KEY,
+				principal TEXT NOT NULL,
+				key_hash TEXT NOT NULL UNIQUE,
+				scopes TEXT[] NOT NULL DEFAULT '{}',
+				status TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'deprecated', 'revoked')),
+				not_before TIMESTAMPTZ NULL,
+				expires_at TIMESTAMPTZ NULL,
+				created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+				last_used_at TIMESTAMPTZ NULL
+			)`,
+			`CREATE INDEX api_keys_principal_idx ON api_keys (principal)`,
+			`CREATE FUNCTION api_keys_notify() RETURNS trigger AS $$
+			BEGIN
+				PERFORM pg_notify('` + PostgresKeyChannel + `', TG_OP);
+				RETURN NULL;
+			END;
+			$$ LANGUAGE plpgsql`,
+			`CREATE TRIGGER api_keys_notify
+				AFTER INSERT OR DELETE OR TRUNCATE OR UPDATE OF id, principal, key_hash, scopes, status, not_before, expires_at
+				ON api_keys
+				FOR EACH STATEMENT EXECUTE PROCEDURE api_keys_notify()`,
+		}),
+		Reverse: migrations.StaticMigration([]string{
+			`DROP TRIGGER api_keys_notify ON api_keys`,
+			`DROP FUNCTION api_keys_notify()`,
+			`DROP TABLE api_keys`,
+		}),
+	},
+}
+
+// QuotaMigrations create the api_key_quota_usage table used by
+// PostgresQuotaCounter. They are independent of Migrations, so a service can
+// append either or both, in any order; do not reorder or edit them.
+var QuotaMigrations = []migrations.NamedMigration{
+	{
+		Name: "Create api_key_quota_usage table",
+		Migration: migrations.StaticMigration([]string{
+			`CREATE TABLE api_key_quota_usage (
+				principal TEXT NOT NULL,
+				quota_window TEXT NOT NULL,
+				window_start TIMESTAMPTZ NOT NULL,
+				request_count BIGINT NOT NULL,
+				PRIMARY KEY (principal, quota_window, window_start)
+			)`,
+			`CREATE INDEX api_key_quota_usage_window_start_idx ON api_key_quota_usage (window_start)`,
+		}),
+		Reverse: migrations.StaticMigration([]string{
+			`DROP TABLE api_key_quota_usage`,
+		}),
+	},
+}
+
+// A UsageRecorder is a KeyStore that tracks when its keys are used. APIKey
+// calls RecordUsage after each successful validation of a key with an ID, so
+// it must not block.
+type UsageRecorder interface {
+	RecordUsage(keyID string, at time.Time)
+}
+
+// PostgresKeyStoreOptions configure NewPostgresKeyStore. The zero value uses
+// the defaults.
+type PostgresKeyStoreOptions struct {
+	// RefreshInterval is how often keys are reloaded regardless of
+	// notifications, which are dropped while the listener reconnects.
+	// Defaults to five minutes.
+	RefreshInterval time.Duration
+
+	// UsageFlushInterval is how often recorded last_used_at times are
+	// written. Defaults to 30 seconds.
+	UsageFlushInterval time.Duration
+
+	// DefaultRateLimit applies to every principal, as default_rate_limit does
+	// in a configuration document.
+	DefaultRateLimit *RateLimit
+
+	// DefaultQuota applies to every principal, as default_quota does in a
+	// configuration document.
+	DefaultQuota *Quota
+
+	// OnReload callbacks are called after each reload that is triggered by a
+	// notification or the refresh interval, with any rows that were skipped
+	// as invalid in ReloadEvent.Skipped.
+	OnReload []OnReload
+}
+
+// PostgresKeyStore is a KeyStore backed by the api_keys table, see
+// Migrations. Keys are cached in memory and reloaded when a change is
+// notified on PostgresKeyChannel, and the time each key was last used is
+// written back in batches.
+type PostgresKeyStore struct {
+	db   *sqlx.DB
+	opts PostgresKeyStoreOptions
+
+	keySet atomic.Pointer[KeySet]
+	loadMu sync.Mutex // serializes loads
+	reload chan struct{}
+
+	usageMu sync.Mutex
+	usage   map[string]time.Time // last use per key ID since the last flush
+}
+
+// NewPostgresKeyStore connects to the database through provider, loads the
+// keys and starts goroutines that listen for changes and flush usage until
+// ctx is done. The database connection is closed once they have stopped.
+func NewPostgresKeyStore(ctx context.Context, provider pgutils.ConnectionStringProvider, opts PostgresKeyStoreOptions) (*PostgresKeyStore, error) {
+	db, err := pgutils.ConnectDB(pgutils.ToConnector(provider))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to API key database: %w", err)
+	}
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = defaultPostgresRefreshInterval
+	}
+	if opts.UsageFlushInterval <= 0 {
+		opts.UsageFlushInterval = defaultUsageFlushInterval
+	}
+	s := &PostgresKeyStore{
+		db:     db,
+		opts:   opts,
+		reload: make(chan struct{}, 1),
+		usage:  map[string]time.Time{},
+	}
+	if err := s.Load(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	notify := func(*pq.Notification) {
+		select {
+		case s.reload <- struct{}{}:
+		default:
+		}
+	}
+	if err := pgutils.Listen(ctx, provider, PostgresKeyChannel, notify, nil); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error listening for API key changes: %w", err)
+	}
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *PostgresKeyStore) KeySet() *KeySet {
+	return s.keySet.Load()
+}
+
+const postgresKeysQuery = `SELECT id, principal, key_hash, scopes, status, not_before, expires_at
+	FROM api_keys
+	ORDER BY principal, created_at, id`
+
+type keyRow struct {
+	ID        string         `db:"id"`
+	Principal string         `db:"principal"`
+	KeyHash   string         `db:"key_hash"`
+	Scopes    pq.StringArray `db:"scopes"`
+	Status    KeyStatus      `db:"status"`
+	NotBefore *time.Time     `db:"not_before"`
+	ExpiresAt *time.Time     `db:"expires_at"`
+}
+
+// Load reads all keys from the database. Rows that are invalid, for example
+// inserted with plain SQL with a scope containing a space, are logged and left
+// out, so the rest of the keys, including revocations, still take effect. If
+// the keys cannot be read the keys in use are kept, and the error is of type
+// ConfigErrors.
+func (s *PostgresKeyStore) Load(ctx context.Context) error {
+	skipped, err := s.load(ctx)
+	for _, err := range skipped {
+		log.Printf("apikey: %s", err)
+	}
+	return err
+}
+
+// load is like Load, but returns the errors of skipped rows rather than
+// logging them.
+func (s *PostgresKeyStore) load(ctx context.Context) ([]error, error) {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+
+	var rows []keyRow
+	if err := s.db.SelectContext(ctx, &rows, postgresKeysQuery); err != nil {
+		return nil, ConfigErrors{errs: []error{fmt.Errorf("error loading API keys: %w", err)}}
+	}
+	config, skipped := configFromRows(rows)
+	config.DefaultRateLimit = s.opts.DefaultRateLimit
+	config.DefaultQuota = s.opts.DefaultQuota
+	if err := validateConfig(&Config{DefaultRateLimit: config.DefaultRateLimit, DefaultQuota: config.DefaultQuota}, "api_keys table"); err != nil {
+		return nil, err
+	}
+	s.keySet.Store(NewKeySetFromConfig(config))
+	return skipped, nil
+}
+
+// configFromRows groups rows, which are ordered by principal, into a Config.
+// Each row is validated on its own; invalid rows are left out and returned as
+// errors.
+func configFromRows(rows []keyRow) (*Config, []error) {
+	config := &Config{}
+	var skipped []error
+	var entry *APIKeyConfig
+	for _, row := range rows {
+		key := Key{
+			ID:        row.ID,
+			Value:     row.KeyHash,
+			NotBefore: row.NotBefore,
+			ExpiresAt: row.ExpiresAt,
+			Status:    row.Status,
+		}
+		if len(row.Scopes) > 0 {
+			key.Scopes = row.Scopes
+		}
+		single := &Config{Principals: []*APIKeyConfig{{Principal: row.Principal, Keys: []Key{key}}}}
+		if err := validateConfig(single, "api_keys table"); err != nil {
+			skipped = append(skipped, fmt.Errorf("skipped invalid API key %s: %w", row.ID, err))
+			continue
+		}
+		if entry == nil || entry.Principal != row.Principal {
+			entry = &APIKeyConfig{Principal: row.Principal}
+			config.Principals = append(config.Principals, entry)
+		}
+		entry.Keys = append(entry.Keys, key)
+	}
+	return config, skipped
+}
+
+// Revoke marks the key keyID as revoked. The cache of this store is reloaded
+// immediately; other stores reload when they are notified. It returns
+// ErrKeyNotFound if there is no such key.
+func (s *PostgresKeyStore) Revoke(ctx context.Context, keyID string) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET status = 'revoked' WHERE id = $1`, keyID)
+	if err != nil {
+		return fmt.Errorf("error revoking API key %s: %w", keyID, err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrKeyNotFound
+	}
+	return s.Load(ctx)
+}
+
+// AddKey inserts key for principal and reloads the cache of this store.
+func (s *PostgresKeyStore) AddKey(ctx context.Context, principal string, key Key) error {
+	if key.ID == "" {
+		return fmt.Errorf("api_keys table key id cannot be empty for principal %s", principal)
+	}
+	if !IsHashedKey(key.Value) {
+		return fmt.Errorf("api_keys table key must be hashed for principal %s", principal)
+	}
+	// Reject what Load would skip.
+	if err := validateConfig(&Config{Principals: []*APIKeyConfig{{Principal: principal, Keys: []Key{key}}}}, "api_keys table"); err != nil {
+		return err
+	}
+	status := key.Status
+	if status == "" {
+		status = KeyStatusActive
+	}
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (id, principal, key_hash, scopes, status, not_before, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		key.ID, principal, key.Value, pq.StringArray(key.Scopes), string(status), key.NotBefore, key.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("error adding API key %s: %w", key.ID, err)
+	}
+	return s.Load(ctx)
+}
+
+// LastUsed returns last_used_at for each key that has been used. Usage not
+// yet flushed is included.
+func (s *PostgresKeyStore) LastUsed(ctx context.Context) (map[string]time.Time, error) {
+	var rows []struct {
+		ID         string    `db:"id"`
+		LastUsedAt time.Time `db:"last_used_at"`
+	}
+	if err := s.db.SelectContext(ctx, &rows, `SELECT id, last_used_at FROM api_keys WHERE last_used_at IS NOT NULL`); err != nil {
+		return nil, fmt.Errorf("error loading API key usage: %w", err)
+	}
+	usage := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		usage[row.ID] = row.LastUsedAt
+	}
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	for id, at := range s.usage {
+		if at.After(usage[id]) {
+			usage[id] = at
+		}
+	}
+	return usage, nil
+}
+
+// RecordUsage notes that keyID was used at the given time. The latest time per
+// key is written to last_used_at on the next flush.
+func (s *PostgresKeyStore) RecordUsage(keyID string, at time.Time) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if last, ok := s.usage[keyID]; !ok || at.After(last) {
+		s.usage[keyID] = at
+	}
+}
+
+func (s *PostgresKeyStore) run(ctx context.Context) {
+	refresh := time.NewTicker(s.opts.RefreshInterval)
+	defer refresh.Stop()
+	flush := time.NewTicker(s.opts.UsageFlushInterval)
+	defer flush.Stop()
+	defer s.db.Close()
+
+	for {
+		select {
+		case <-s.reload:
+			s.poll(ctx)
+		case <-refresh.C:
+			s.poll(ctx)
+		case <-flush.C:
+			if err := s.flushUsage(ctx); err != nil {
+				log.Printf("apikey: failed to record API key usage: %s", err)
+			}
+		case <-ctx.Done():
+			// Write the remaining usage even though ctx is done.
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := s.flushUsage(flushCtx); err != nil {
+				log.Printf("apikey: failed to record API key usage: %s", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+func (s *PostgresKeyStore) poll(ctx context.Context) {
+	skipped, err := s.load(ctx)
+	event := ReloadEvent{Source: "api_keys table", Err: err, Skipped: skipped}
+	for _, callback := range s.opts.OnReload {
+		callback(ctx, event)
+	}
+}
+
+// flushUsage writes the recorded usage to last_used_at. Usage that fails to
+// be written is kept for the next flush.
+func (s *PostgresKeyStore) flushUsage(ctx context.Context) error {
+	s.usageMu.Lock()
+	usage := s.usage
+	s.usage = map[string]time.Time{}
+	s.usageMu.Unlock()
+	if len(usage) == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(usage))
+	times := make([]string, 0, len(usage))
+	for id, at := range usage {
+		ids = append(ids, id)
+		times = append(times, at.Format(time.RFC3339Nano))
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE api_keys
+		SET last_used_at = GREATEST(api_keys.last_used_at, u.used_at)
+		FROM unnest($1::text[], $2::timestamptz[]) AS u(id, used_at)
+		WHERE api_keys.id = u.id`, pq.Array(ids), pq.Array(times))
+	if err != nil {
+		for id, at := range usage {
+			s.RecordUsage(id, at)
+		}
+		return err
+	}
+	return nil
+}
+
+// PostgresQuotaCounter is a QuotaCounter backed by the api_key_quota_usage
+// table, see QuotaMigrations, so a quota is shared by all instances of a service.
+// Each allowed request is counted with a single statement that also enforces
+// the limit.
+type PostgresQuotaCounter struct {
+	db  *sqlx.DB
+	now func() time.Time
+}
+
+// NewPostgresQuotaCounter connects to the database through provider. Close
+// the counter when it is no longer needed.
+func NewPostgresQuotaCounter(provider pgutils.ConnectionStringProvider) (*PostgresQuotaCounter, error) {
+	db, err := pgutils.ConnectDB(pgutils.ToConnector(provider))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to API key quota database: %w", err)
+	}
+	return &PostgresQuotaCounter{db: db, now: time.Now}, nil
+}
+
+// The update is skipped, and no row returned, once the window's count has
+// reached the limit.
+const postgresQuotaQuery = `INSERT INTO api_key_quota_usage (principal, quota_window, window_start, request_count)
+	VALUES ($1, $2, $3, 1)
+	ON CONFLICT (principal, quota_window, window_start) DO UPDATE
+		SET request_count = api_key_quota_usage.request_count + 1
+		WHERE api_key_quota_usage.request_count < $4
+	RETURNING request_count`
+
+func (c *PostgresQuotaCounter) Allow(ctx context.Context, principal string, quota Quota) (QuotaDecision, error) {
+	now := c.now()
+	window := quota.window()
+	start := window.start(now)
+	if quota.Limit <= 0 {
+		return newQuotaDecision(quota, 0, false, start, now), nil
+	}
+
+	var count int64
+	err := c.db.GetContext(ctx, &count, postgresQuotaQuery, principal, string(window), start, quota.Limit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newQuotaDecision(quota, quota.Limit, false, start, now), nil
+	}
+	if err != nil {
+		return QuotaDecision{}, fmt.Errorf("error counting API key quota for principal %s: %w", principal, err)
+	}
+	return newQuotaDecision(quota, count, true, start, now), nil
+}
+
+// UsageReport returns the counts of the windows starting in [from, to),
+// ordered by principal and start, for billing.
+func (c *PostgresQuotaCounter) UsageReport(ctx context.Context, from, to time.Time) ([]QuotaUsage, error) {
+	var rows []struct {
+		Principal    string      `db:"principal"`
+		Window       QuotaWindow `db:"quota_window"`
+		WindowStart  time.Time   `db:"window_start"`
+		RequestCount int64       `db:"request_count"`
+	}
+	err := c.db.SelectContext(ctx, &rows, `SELECT principal, quota_window, window_start, request_count
+		FROM api_key_quota_usage
+		WHERE window_start >= $1 AND window_start < $2
+		ORDER BY principal, window_start, quota_window`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error loading API key quota usage: %w", err)
+	}
+	report := make([]QuotaUsage, 0, len(rows))
+	for _, row := range rows {
+		report = append(report, QuotaUsage{Principal: row.Principal, Window: row.Window, Start: row.WindowStart.UTC(), Count: row.RequestCount})
+	}
+	return report, nil
+}
+
+func (c *PostgresQuotaCounter) Close() error {
+	return c.db.Close()
+}
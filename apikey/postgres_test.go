@@ -0,0 +1,188 @@
+package apikey
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/corbaltcode/go-libraries/migrations"
+	"github.com/corbaltcode/go-libraries/pgutils"
+)
+
+// postgresTestURLEnvVarName names the database used by the Postgres tests,
+// which are skipped when it is unset.
+const postgresTestURLEnvVarName = "APIKEY_TEST_POSTGRES_URL"
+
+func TestConfigFromRows(t *testing.T) {
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	config, skipped := configFromRows([]keyRow{
+		{ID: "a1", Principal: "alpha", KeyHash: HashKey("4LPH4K3Y01234567"), Status: KeyStatusActive},
+		{ID: "a2", Principal: "alpha", KeyHash: HashKey("4LPH4K3Y76543210"), Status: KeyStatusRevoked, ExpiresAt: &expiresAt},
+		{ID: "a3", Principal: "alpha", KeyHash: HashKey("1NV4L1DK3Y012345"), Status: KeyStatusRevoked, NotBefore: &expiresAt, ExpiresAt: &expiresAt},
+		{ID: "b1", Principal: "beta", KeyHash: HashKey("B374K3Y012345678"), Status: KeyStatusActive, Scopes: []string{"reports:read"}},
+		{ID: "b2", Principal: "beta", KeyHash: HashKey("B374K3Y876543210"), Status: KeyStatusActive, Scopes: []string{"reports read"}},
+	})
+	if err := validateConfig(config, "test"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(skipped) != 2 || !strings.Contains(skipped[0].Error(), "a3") || !strings.Contains(skipped[1].Error(), "b2") {
+		t.Errorf("expected invalid rows a3 and b2 to be skipped, got %v", skipped)
+	}
+	if len(config.Principals) != 2 || len(config.Principals[0].Keys) != 2 || len(config.Principals[1].Keys) != 1 {
+		t.Fatalf("expected keys grouped by principal, got %+v", config.Principals)
+	}
+	if key := config.Principals[0].Keys[1]; key.ID != "a2" || key.Status != KeyStatusRevoked || key.ExpiresAt == nil || !key.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("unexpected key %+v", key)
+	}
+	if scopes := config.Principals[1].Keys[0].Scopes; len(scopes) != 1 || scopes[0] != "reports:read" {
+		t.Errorf("expected key scopes [reports:read], got %v", scopes)
+	}
+}
+
+func TestPostgresKeyStore(t *testing.T) {
+	dsn := os.Getenv(postgresTestURLEnvVarName)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresTestURLEnvVarName)
+	}
+	log.SetOutput(ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := pgutils.ConnectWithSchemaForTest(dsn, t)
+	if err := migrations.Migrate(db, Migrations); err != nil {
+		t.Fatalf("unexpected error migrating: %s", err)
+	}
+	var schema string
+	if err := db.Get(&schema, `SELECT current_schema()`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	db.MustExec(`INSERT INTO api_keys (id, principal, key_hash) VALUES ('pg-1', 'pg-team', $1)`, HashKey("P057GR35K3Y01234"))
+
+	provider, err := pgutils.NewConnectionStringProviderFromURLString(ctx, dsn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	store, err := NewPostgresKeyStore(ctx, pgutils.WithSchemaSearchPath(provider, schema), PostgresKeyStoreOptions{UsageFlushInterval: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pgAPI := &APIKey{Store: store}
+	validate := func(key string) Result {
+		return pgAPI.Validate(&http.Request{Header: http.Header{"Authorization": []string{"Bearer " + key}}})
+	}
+	eventually := func(description string, condition func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if condition() {
+				return
+			}
+		}
+		t.Fatalf("timed out waiting for %s", description)
+	}
+
+	if result := validate("P057GR35K3Y01234"); !result.IsValid() || result.Principal != "pg-team" || result.KeyID != "pg-1" {
+		t.Fatalf("expected key to be valid, got status %d principal %q", result.StatusCode, result.Principal)
+	}
+	eventually("last_used_at to be recorded", func() bool {
+		var used bool
+		return db.Get(&used, `SELECT last_used_at IS NOT NULL FROM api_keys WHERE id = 'pg-1'`) == nil && used
+	})
+
+	// Keys added and revoked with plain SQL are picked up through notifications.
+	db.MustExec(`INSERT INTO api_keys (id, principal, key_hash) VALUES ('pg-2', 'pg-team', $1)`, HashKey("N3WP057GR35K3Y01"))
+	eventually("added key to be valid", func() bool { return validate("N3WP057GR35K3Y01").IsValid() })
+	db.MustExec(`UPDATE api_keys SET status = 'revoked' WHERE id = 'pg-2'`)
+	eventually("revoked key to be rejected", func() bool { return validate("N3WP057GR35K3Y01").Error == ErrAPIKeyRevoked })
+
+	// An invalid row is skipped rather than blocking later revocations.
+	db.MustExec(`INSERT INTO api_keys (id, principal, key_hash, scopes) VALUES ('pg-bad', 'pg-team', $1, '{"bad scope"}')`, HashKey("B4DP057GR35K3Y01"))
+	if err := store.Revoke(ctx, "pg-1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result := validate("P057GR35K3Y01234"); result.Error != ErrAPIKeyRevoked {
+		t.Errorf("expected key revoked through the store to be rejected immediately, got %v", result.Error)
+	}
+	if err := store.Revoke(ctx, "missing"); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound but got %v", err)
+	}
+
+	if err := store.AddKey(ctx, "pg-team", Key{ID: "pg-3", Value: HashKey("4DD3DP057GR35K3Y")}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result := validate("4DD3DP057GR35K3Y"); !result.IsValid() {
+		t.Errorf("expected key added through the store to be valid immediately, got %v", result.Error)
+	}
+	usage, err := store.LastUsed(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, ok := usage["pg-1"]; !ok {
+		t.Errorf("expected last use of pg-1, got %v", usage)
+	}
+}
+
+func TestPostgresQuotaCounter(t *testing.T) {
+	dsn := os.Getenv(postgresTestURLEnvVarName)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresTestURLEnvVarName)
+	}
+	ctx := context.Background()
+
+	db := pgutils.ConnectWithSchemaForTest(dsn, t)
+	if err := migrations.Migrate(db, QuotaMigrations); err != nil {
+		t.Fatalf("unexpected error migrating: %s", err)
+	}
+	var schema string
+	if err := db.Get(&schema, `SELECT current_schema()`); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	provider, err := pgutils.NewConnectionStringProviderFromURLString(ctx, dsn)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Two counters stand in for two instances of a service.
+	now := time.Date(2026, 4, 1, 12, 0, 0, 0, time.UTC)
+	var counters []*PostgresQuotaCounter
+	for i := 0; i < 2; i++ {
+		counter, err := NewPostgresQuotaCounter(pgutils.WithSchemaSearchPath(provider, schema))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer counter.Close()
+		counter.now = func() time.Time { return now }
+		counters = append(counters, counter)
+	}
+
+	quota := Quota{Limit: 3}
+	var allowed int
+	for i := 0; i < 5; i++ {
+		decision, err := counters[i%2].Allow(ctx, "pg-team", quota)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if decision.Allowed {
+			allowed++
+		}
+		if decision.Reset != 12*time.Hour {
+			t.Errorf("expected Reset 12h but got %s", decision.Reset)
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("expected 3 requests allowed across instances but got %d", allowed)
+	}
+
+	report, err := counters[0].UsageReport(ctx, now.AddDate(0, 0, -1), now)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := QuotaUsage{Principal: "pg-team", Window: QuotaWindowDay, Start: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), Count: 3}
+	if len(report) != 1 || report[0] != expected {
+		t.Errorf("expected report [%v] but got %v", expected, report)
+	}
+}
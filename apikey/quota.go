@@ -0,0 +1,197 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+const quotaPruneInterval = time.Minute
+
+// QuotaWindow is the period over which a Quota is counted. Windows are
+// calendar periods in UTC, so every instance of a service agrees on them.
+type QuotaWindow string
+
+const (
+	QuotaWindowHour  QuotaWindow = "hour"
+	QuotaWindowDay   QuotaWindow = "day"
+	QuotaWindowMonth QuotaWindow = "month"
+)
+
+// Quota caps the number of requests a principal may make per window. Unlike
+// a RateLimit, which smooths out bursts, a quota is a contractual allowance
+// and the counts are kept for billing, see QuotaUsage.
+type Quota struct {
+	Limit  int64       `json:"limit"`
+	Window QuotaWindow `json:"window,omitempty"` // defaults to QuotaWindowDay
+}
+
+func (q Quota) window() QuotaWindow {
+	if q.Window == "" {
+		return QuotaWindowDay
+	}
+	return q.Window
+}
+
+// start returns the start of the window containing t.
+func (w QuotaWindow) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch w {
+	case QuotaWindowHour:
+		return t.Truncate(time.Hour)
+	case QuotaWindowMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// end returns the end of the window starting at start.
+func (w QuotaWindow) end(start time.Time) time.Time {
+	switch w {
+	case QuotaWindowHour:
+		return start.Add(time.Hour)
+	case QuotaWindowMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// QuotaDecision is the outcome of a QuotaCounter.Allow call.
+type QuotaDecision struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64         // requests left in the window after this one
+	Reset     time.Duration // the wait until the next window starts
+}
+
+// A QuotaCounter counts requests against a Quota per principal. Requests are
+// counted only when they are allowed. The middleware counts a request before
+// any RequireScopes or RequireRouteScopes handler runs, so requests those
+// handlers reject with 403 Forbidden are counted too. PostgresQuotaCounter
+// shares the counts between all instances of a service.
+type QuotaCounter interface {
+	Allow(ctx context.Context, principal string, quota Quota) (QuotaDecision, error)
+}
+
+// QuotaUsage is the number of requests a principal made in one window.
+type QuotaUsage struct {
+	Principal string
+	Window    QuotaWindow
+	Start     time.Time
+	Count     int64
+}
+
+func newQuotaDecision(quota Quota, count int64, allowed bool, start, now time.Time) QuotaDecision {
+	return QuotaDecision{
+		Allowed:   allowed,
+		Limit:     quota.Limit,
+		Remaining: max(0, quota.Limit-count),
+		Reset:     quota.window().end(start).Sub(now),
+	}
+}
+
+// MemoryQuotaCounter is a QuotaCounter that keeps its counts in memory, so
+// each instance of a service enforces the quota separately and the counts are
+// lost on restart. The counts of windows that have ended are discarded, so
+// UsageReport only covers windows in progress. It is meant for tests and
+// single-instance services.
+type MemoryQuotaCounter struct {
+	mu        sync.Mutex
+	counts    map[quotaKey]int64
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type quotaKey struct {
+	principal string
+	window    QuotaWindow
+	start     time.Time
+}
+
+func NewMemoryQuotaCounter() *MemoryQuotaCounter {
+	return &MemoryQuotaCounter{counts: map[quotaKey]int64{}, now: time.Now}
+}
+
+func (c *MemoryQuotaCounter) Allow(ctx context.Context, principal string, quota Quota) (QuotaDecision, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if now.Sub(c.lastPrune) >= quotaPruneInterval {
+		for key := range c.counts {
+			if !now.Before(key.window.end(key.start)) {
+				delete(c.counts, key)
+			}
+		}
+		c.lastPrune = now
+	}
+	key := quotaKey{principal: principal, window: quota.window(), start: quota.window().start(now)}
+	count := c.counts[key]
+	allowed := count < quota.Limit
+	if allowed {
+		count++
+		c.counts[key] = count
+	}
+	return newQuotaDecision(quota, count, allowed, key.start, now), nil
+}
+
+// UsageReport returns the counts of the windows starting in [from, to),
+// ordered by principal and start.
+func (c *MemoryQuotaCounter) UsageReport(ctx context.Context, from, to time.Time) ([]QuotaUsage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var report []QuotaUsage
+	for key, count := range c.counts {
+		if !key.start.Before(from) && key.start.Before(to) {
+			report = append(report, QuotaUsage{Principal: key.principal, Window: key.window, Start: key.start, Count: count})
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Principal != report[j].Principal {
+			return report[i].Principal < report[j].Principal
+		}
+		if !report[i].Start.Equal(report[j].Start) {
+			return report[i].Start.Before(report[j].Start)
+		}
+		return report[i].Window < report[j].Window
+	})
+	return report, nil
+}
+
+// allowQuota applies the quota of the authenticated principal, writing the
+// Quota-* headers and, when the quota is used up, Retry-After and returning
+// ErrQuotaExceeded. Errors from the counter are logged and the request is
+// allowed.
+func (a *APIKey) allowQuota(w http.ResponseWriter, r *http.Request, counter QuotaCounter) error {
+	result, ok := ResultFromContext(r.Context())
+	if !ok || result.Quota == nil {
+		return nil
+	}
+	decision, err := counter.Allow(r.Context(), result.Principal, *result.Quota)
+	if err != nil {
+		log.Printf("API key quota counter failed for principal %s, allowing request: %s", result.Principal, err)
+		return nil
+	}
+
+	header := w.Header()
+	header.Set("Quota-Limit", strconv.FormatInt(decision.Limit, 10))
+	header.Set("Quota-Remaining", strconv.FormatInt(decision.Remaining, 10))
+	header.Set("Quota-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	if !decision.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.Reset)))
+		log.Printf("API key quota exceeded for principal %s", result.Principal)
+		a.notify(r, Result{Principal: result.Principal, KeyID: result.KeyID, StatusCode: http.StatusTooManyRequests, Error: ErrQuotaExceeded}, OutcomeQuotaExceeded)
+		return ErrQuotaExceeded
+	}
+	return nil
+}
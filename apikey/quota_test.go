@@ -0,0 +1,139 @@
+package apikey
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQuotaWindowStart(t *testing.T) {
+	at := time.Date(2026, 3, 31, 22, 45, 10, 0, time.FixedZone("EST", -5*60*60))
+	tests := []struct {
+		Window        QuotaWindow
+		ExpectedStart time.Time
+		ExpectedEnd   time.Time
+	}{
+		{Window: QuotaWindowHour, ExpectedStart: time.Date(2026, 4, 1, 3, 0, 0, 0, time.UTC), ExpectedEnd: time.Date(2026, 4, 1, 4, 0, 0, 0, time.UTC)},
+		{Window: QuotaWindowDay, ExpectedStart: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), ExpectedEnd: time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC)},
+		{Window: QuotaWindowMonth, ExpectedStart: time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), ExpectedEnd: time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		start := test.Window.start(at)
+		if !start.Equal(test.ExpectedStart) {
+			t.Errorf("%s: expected start %s but got %s", test.Window, test.ExpectedStart, start)
+		}
+		if end := test.Window.end(start); !end.Equal(test.ExpectedEnd) {
+			t.Errorf("%s: expected end %s but got %s", test.Window, test.ExpectedEnd, end)
+		}
+	}
+}
+
+func TestMemoryQuotaCounter(t *testing.T) {
+	now := time.Date(2026, 4, 1, 23, 0, 0, 0, time.UTC)
+	counter := NewMemoryQuotaCounter()
+	counter.now = func() time.Time { return now }
+	quota := Quota{Limit: 2}
+	ctx := context.Background()
+
+	steps := []struct {
+		Name              string
+		Advance           time.Duration
+		Principal         string
+		ExpectedAllowed   bool
+		ExpectedRemaining int64
+		ExpectedReset     time.Duration
+	}{
+		{Name: "First request", Principal: "a", ExpectedAllowed: true, ExpectedRemaining: 1, ExpectedReset: time.Hour},
+		{Name: "Second request", Principal: "a", ExpectedAllowed: true, ExpectedRemaining: 0, ExpectedReset: time.Hour},
+		{Name: "Quota used up", Principal: "a", ExpectedAllowed: false, ExpectedRemaining: 0, ExpectedReset: time.Hour},
+		{Name: "Other principal unaffected", Principal: "b", ExpectedAllowed: true, ExpectedRemaining: 1, ExpectedReset: time.Hour},
+		{Name: "Still used up", Advance: 30 * time.Minute, Principal: "a", ExpectedAllowed: false, ExpectedRemaining: 0, ExpectedReset: 30 * time.Minute},
+		{Name: "Next day", Advance: 30 * time.Minute, Principal: "a", ExpectedAllowed: true, ExpectedRemaining: 1, ExpectedReset: 24 * time.Hour},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.Advance)
+		decision, err := counter.Allow(ctx, step.Principal, quota)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.Name, err)
+		}
+		if decision.Allowed != step.ExpectedAllowed {
+			t.Errorf("%s: expected Allowed %v but got %v", step.Name, step.ExpectedAllowed, decision.Allowed)
+		}
+		if decision.Remaining != step.ExpectedRemaining {
+			t.Errorf("%s: expected Remaining %d but got %d", step.Name, step.ExpectedRemaining, decision.Remaining)
+		}
+		if decision.Reset != step.ExpectedReset {
+			t.Errorf("%s: expected Reset %s but got %s", step.Name, step.ExpectedReset, decision.Reset)
+		}
+	}
+
+	report, err := counter.UsageReport(ctx, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 4, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// The windows of April 1 ended before the last request and were pruned.
+	expected := []QuotaUsage{
+		{Principal: "a", Window: QuotaWindowDay, Start: time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC), Count: 1},
+	}
+	if len(report) != len(expected) {
+		t.Fatalf("expected report %v but got %v", expected, report)
+	}
+	for i := range expected {
+		if report[i] != expected[i] {
+			t.Errorf("expected report entry %d to be %v but got %v", i, expected[i], report[i])
+		}
+	}
+	if len(counter.counts) != 1 {
+		t.Errorf("expected ended windows to be pruned, got %v", counter.counts)
+	}
+}
+
+func TestValidateHandlerQuota(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	config, err := ParseConfigJSON([]byte(`{
+		"default_quota": {"limit": 1},
+		"principals": [
+			{"principal": "partner", "keys": ["P4R7N3RK3Y012345"]},
+			{"principal": "internal", "keys": ["1N73RN4LK3Y01234"], "quota": {"limit": 100, "window": "hour"}}
+		]
+	}`), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	quotaAPI := &APIKey{Store: NewKeySetFromConfig(config)}
+	var events []ValidateEvent
+	quotaAPI.OnValidate = []OnValidate{func(ctx context.Context, event ValidateEvent) { events = append(events, event) }}
+	handler := quotaAPI.ValidateHandlerWithOptions(http.HandlerFunc(testHandleFunc), HandlerOptions{QuotaCounter: NewMemoryQuotaCounter()})
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, testURL, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("P4R7N3RK3Y012345"); w.Code != http.StatusOK || w.Header().Get("Quota-Limit") != "1" || w.Header().Get("Quota-Remaining") != "0" || w.Header().Get("Quota-Reset") == "" {
+		t.Errorf("expected first request to pass with quota headers, got %d %v", w.Code, w.Header())
+	}
+	w := serve("P4R7N3RK3Y012345")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d but got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != w.Header().Get("Quota-Reset") {
+		t.Errorf("expected Retry-After to equal Quota-Reset, got %v", w.Header())
+	}
+	if last := events[len(events)-1]; last.Outcome != OutcomeQuotaExceeded || last.Principal != "partner" {
+		t.Errorf("expected quota_exceeded event for partner, got %+v", last)
+	}
+	for i := 0; i < 10; i++ {
+		if w := serve("1N73RN4LK3Y01234"); w.Code != http.StatusOK {
+			t.Fatalf("expected principal with its own quota to pass, got %d", w.Code)
+		}
+	}
+}
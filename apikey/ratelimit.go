@@ -0,0 +1,145 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+
+// RateLimit is a token bucket refilled at RequestsPerSecond and holding up to
+// Burst tokens. Each request consumes one token.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst,omitempty"` // defaults to RequestsPerSecond rounded up
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return int(math.Max(1, math.Ceil(l.RequestsPerSecond)))
+}
+
+// RateLimitDecision is the outcome of a RateLimiter.Allow call.
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int           // bucket capacity
+	Remaining  int           // whole tokens left after this request
+	RetryAfter time.Duration // when not allowed, the wait until a token is available
+	Reset      time.Duration // the wait until the bucket is full again
+}
+
+// A RateLimiter enforces a RateLimit per key, which ValidateHandlerWithOptions
+// sets to the principal. Implementations backed by a shared store, such as
+// Postgres, enforce a limit across all instances of a service.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitDecision, error)
+}
+
+// MemoryRateLimiter is a RateLimiter that keeps its buckets in memory, so each
+// instance of a service enforces the limit separately.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	rate    float64
+	burst   float64
+	updated time.Time
+}
+
+const rateLimiterPruneInterval = time.Minute
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitDecision, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(limit.burst()), updated: now}
+		l.buckets[key] = b
+	}
+	// The limit may have changed since the bucket was created, e.g. after a reload.
+	b.rate, b.burst = limit.RequestsPerSecond, float64(limit.burst())
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+
+	decision := RateLimitDecision{Limit: limit.burst()}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = b.wait(1 - b.tokens)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = b.wait(b.burst - b.tokens)
+
+	if now.Sub(l.lastPrune) >= rateLimiterPruneInterval {
+		l.prune(now)
+	}
+	return decision, nil
+}
+
+// wait returns how long the bucket takes to gain the given number of tokens.
+func (b *tokenBucket) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / b.rate * float64(time.Second))
+}
+
+// prune drops buckets that would have refilled completely, since they are
+// indistinguishable from new ones.
+func (l *MemoryRateLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= b.wait(b.burst-b.tokens) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// allowRate applies the rate limit of the authenticated principal, writing the
+// RateLimit-* headers and, when the limit is exceeded, Retry-After and
+// returning ErrRateLimitExceeded. Errors from the limiter are logged and the
+// request is allowed.
+func (a *APIKey) allowRate(w http.ResponseWriter, r *http.Request, limiter RateLimiter) error {
+	result, ok := ResultFromContext(r.Context())
+	if !ok || result.RateLimit == nil {
+		return nil
+	}
+	decision, err := limiter.Allow(r.Context(), result.Principal, *result.RateLimit)
+	if err != nil {
+		log.Printf("API key rate limiter failed for principal %s, allowing request: %s", result.Principal, err)
+		return nil
+	}
+
+	header := w.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	if !decision.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+		log.Printf("API key rate limit exceeded for principal %s", result.Principal)
+		a.notify(r, Result{Principal: result.Principal, KeyID: result.KeyID, StatusCode: http.StatusTooManyRequests, Error: ErrRateLimitExceeded}, OutcomeRateLimited)
+		return ErrRateLimitExceeded
+	}
+	return nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
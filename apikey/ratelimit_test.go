@@ -0,0 +1,97 @@
+package apikey
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time { return now }
+	limit := RateLimit{RequestsPerSecond: 1, Burst: 2}
+	ctx := context.Background()
+
+	steps := []struct {
+		Name              string
+		Advance           time.Duration
+		Key               string
+		ExpectedAllowed   bool
+		ExpectedRemaining int
+		ExpectedRetry     time.Duration
+	}{
+		{Name: "First request", Key: "a", ExpectedAllowed: true, ExpectedRemaining: 1},
+		{Name: "Second request uses burst", Key: "a", ExpectedAllowed: true, ExpectedRemaining: 0},
+		{Name: "Third request limited", Key: "a", ExpectedAllowed: false, ExpectedRemaining: 0, ExpectedRetry: time.Second},
+		{Name: "Other key unaffected", Key: "b", ExpectedAllowed: true, ExpectedRemaining: 1},
+		{Name: "Partially refilled", Advance: 500 * time.Millisecond, Key: "a", ExpectedAllowed: false, ExpectedRemaining: 0, ExpectedRetry: 500 * time.Millisecond},
+		{Name: "Refilled one token", Advance: 500 * time.Millisecond, Key: "a", ExpectedAllowed: true, ExpectedRemaining: 0},
+		{Name: "Refill capped at burst", Advance: time.Hour, Key: "a", ExpectedAllowed: true, ExpectedRemaining: 1},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.Advance)
+		decision, err := limiter.Allow(ctx, step.Key, limit)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", step.Name, err)
+		}
+		if decision.Allowed != step.ExpectedAllowed {
+			t.Errorf("%s: expected Allowed %v but got %v", step.Name, step.ExpectedAllowed, decision.Allowed)
+		}
+		if decision.Remaining != step.ExpectedRemaining {
+			t.Errorf("%s: expected Remaining %d but got %d", step.Name, step.ExpectedRemaining, decision.Remaining)
+		}
+		if decision.RetryAfter != step.ExpectedRetry {
+			t.Errorf("%s: expected RetryAfter %s but got %s", step.Name, step.ExpectedRetry, decision.RetryAfter)
+		}
+	}
+
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected idle bucket to be pruned, %d buckets remain", len(limiter.buckets))
+	}
+}
+
+func TestValidateHandlerRateLimit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	config, err := ParseConfigJSON([]byte(`{
+		"default_rate_limit": {"requests_per_second": 0.5, "burst": 1},
+		"principals": [
+			{"principal": "limited", "keys": ["L1M173DK3Y012345"]},
+			{"principal": "generous", "keys": ["G3N3R0U5K3Y01234"], "rate_limit": {"requests_per_second": 100}}
+		]
+	}`), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	limitedAPI := &APIKey{Store: NewKeySetFromConfig(config)}
+	handler := limitedAPI.ValidateHandlerWithOptions(http.HandlerFunc(testHandleFunc), HandlerOptions{RateLimiter: NewMemoryRateLimiter()})
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, testURL, nil)
+		r.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("L1M173DK3Y012345"); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("expected first request to pass with rate limit headers, got %d %v", w.Code, w.Header())
+	}
+	w := serve("L1M173DK3Y012345")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d but got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("expected Retry-After 2 but got %q", w.Header().Get("Retry-After"))
+	}
+	for i := 0; i < 10; i++ {
+		if w := serve("G3N3R0U5K3Y01234"); w.Code != http.StatusOK {
+			t.Fatalf("expected principal with its own limit to pass, got %d", w.Code)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package apikey
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const defaultReloadInterval = time.Minute
+
+// ReloadEvent describes the outcome of a reload attempt by a ReloadingKeyStore
+// or PostgresKeyStore.
+type ReloadEvent struct {
+	Source  string
+	Err     error   // nil when new keys were loaded; the previous keys stay in use otherwise
+	Skipped []error // invalid keys left out of the keys loaded, by PostgresKeyStore only
+}
+
+// OnReload is called synchronously from the polling goroutine whenever a
+// ReloadingKeyStore loads new keys or fails to. Polls that find the source
+// unchanged are not reported.
+type OnReload func(ctx context.Context, event ReloadEvent)
+
+// ReloadingKeyStore is a SourceKeyStore that polls its source and swaps in
+// new keys when the document changes, so keys can be rotated without
+// restarting the service. A document that fails to fetch or validate is
+// reported and the last good keys remain in use.
+type ReloadingKeyStore struct {
+	*SourceKeyStore
+	interval time.Duration
+	onReload []OnReload
+}
+
+// NewReloadingKeyStore loads the initial keys from source and starts a
+// goroutine that checks it for changes every interval (one minute if zero)
+// until ctx is done. Failure to load the initial keys is returned rather than
+// reported through onReload.
+func NewReloadingKeyStore(ctx context.Context, source ConfigSource, interval time.Duration, onReload ...OnReload) (*ReloadingKeyStore, error) {
+	store, err := NewSourceKeyStore(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = defaultReloadInterval
+	}
+	s := &ReloadingKeyStore{SourceKeyStore: store, interval: interval, onReload: onReload}
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *ReloadingKeyStore) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.poll(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *ReloadingKeyStore) poll(ctx context.Context) {
+	changed, err := s.reload(ctx, false)
+	if !changed && err == nil {
+		return
+	}
+	event := ReloadEvent{Source: s.source.String(), Err: err}
+	for _, callback := range s.onReload {
+		callback(ctx, event)
+	}
+}
+
+// LogOnReload returns an OnReload callback that logs each reload outcome to
+// the provided logger.
+func LogOnReload(logger *log.Logger) OnReload {
+	return func(_ context.Context, event ReloadEvent) {
+		if event.Err != nil {
+			logger.Printf("apikey: failed to reload keys from %s, keeping previous keys: %s", event.Source, event.Err)
+		} else {
+			logger.Printf("apikey: reloaded keys from %s", event.Source)
+		}
+		for _, err := range event.Skipped {
+			logger.Printf("apikey: %s", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package apikey
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var ErrInsufficientScope = errors.New("API key lacks the scope required for this request")
+
+// HasScopes reports whether the result grants every one of the given scopes.
+func (r Result) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !containsScope(r.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteScope lists the scopes required for requests matching Method and Path.
+type RouteScope struct {
+	Method string // empty matches any method
+	Path   string // exact path, or a path prefix when it ends in "/"
+	Scopes []string
+}
+
+func (rs RouteScope) matches(r *http.Request) bool {
+	return matchRoute(rs.Method, rs.Path, r)
+}
+
+// matchRoute reports whether r has the given method, unless it is empty, and
+// path, which matches as a prefix when it ends in "/". The request path is
+// cleaned first, see cleanPath.
+func matchRoute(method, path string, r *http.Request) bool {
+	if method != "" && method != r.Method {
+		return false
+	}
+	requestPath := cleanPath(r.URL.Path)
+	if strings.HasSuffix(path, "/") {
+		return strings.HasPrefix(requestPath, path)
+	}
+	return requestPath == path
+}
+
+// RequireScopes is an http.Handler that only passes requests through to h when
+// the API key is valid and grants all of the given scopes. A result already
+// stored in the request context by ValidateHandler is reused; otherwise the
+// request is validated and authentication failures are answered as in
+// ValidateHandler. Valid keys lacking a scope are answered with 403 Forbidden.
+func (a *APIKey) RequireScopes(h http.Handler, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := a.authorize(w, r, scopes); ok {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// RequireRouteScopes is like RequireScopes, but looks up the required scopes
+// in routes. The first matching route applies; requests that match no route
+// only require a valid API key.
+func (a *APIKey) RequireRouteScopes(h http.Handler, routes []RouteScope) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var scopes []string
+		for _, route := range routes {
+			if route.matches(r) {
+				scopes = route.Scopes
+				break
+			}
+		}
+		if r, ok := a.authorize(w, r, scopes); ok {
+			h.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Authorize is like Validate, but a valid key must also grant all of the
+// given scopes. A key lacking one is reported to the OnValidate callbacks as
+// forbidden and its Result has status 403 and ErrInsufficientScope. It is
+// meant for transports that cannot use RequireScopes, such as gRPC.
+func (a *APIKey) Authorize(req *http.Request, scopes ...string) Result {
+	result := a.Validate(req)
+	if !result.IsValid() {
+		return result
+	}
+	return a.checkScopes(req, result, scopes)
+}
+
+// authorize authenticates the request and checks it against the required
+// scopes. On success it returns the request with the Result stored in its
+// context; otherwise it writes the error response and returns false.
+func (a *APIKey) authorize(w http.ResponseWriter, r *http.Request, scopes []string) (*http.Request, bool) {
+	r, result := a.authenticate(w, r)
+	if !result.IsValid() {
+		a.rejectInvalid(w, r, result)
+		return nil, false
+	}
+	if result := a.checkScopes(r, result, scopes); !result.IsValid() {
+		a.writeError(w, r, result.StatusCode, result.Error)
+		return nil, false
+	}
+	return r, true
+}
+
+// checkScopes rejects a valid result that lacks any of the required scopes.
+func (a *APIKey) checkScopes(r *http.Request, result Result, scopes []string) Result {
+	if result.HasScopes(scopes...) {
+		return result
+	}
+	log.Printf("API key for principal %s lacks required scopes %v", result.Principal, scopes)
+	a.notify(r, Result{Principal: result.Principal, KeyID: result.KeyID, StatusCode: http.StatusForbidden, Error: ErrInsufficientScope}, OutcomeForbidden)
+	result.Deprecated = false
+	result.StatusCode, result.Error = http.StatusForbidden, ErrInsufficientScope
+	return result
+}
+
+// authenticate returns the Result already stored in the request context or
+// validates the request. A newly validated key is stored in the context of
+// the returned request.
+func (a *APIKey) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, Result) {
+	if result, ok := ResultFromContext(r.Context()); ok {
+		return r, result
+	}
+	result := a.Validate(r)
+	if !result.IsValid() {
+		return r, result
+	}
+	return a.WithResult(w, r, result), result
+}
+
+// WithResult prepares a request whose key was validated as result for the
+// next handler, as the middleware does: it sets a Warning header on the
+// response if the key is deprecated, removes keys read by QueryExtractors
+// from the URL so they are not logged, and stores result in the request
+// context. Use it when calling Validate from other middleware.
+func (a *APIKey) WithResult(w http.ResponseWriter, r *http.Request, result Result) *http.Request {
+	if result.Deprecated {
+		w.Header().Set("Warning", deprecatedKeyWarning)
+	}
+	r = a.stripQueryKeys(r)
+	return r.WithContext(NewContext(r.Context(), result))
+}
+
+// rejectInvalid writes the error response for a failed validation.
+func (a *APIKey) rejectInvalid(w http.ResponseWriter, r *http.Request, result Result) {
+	log.Printf("API key failed validation: status %d, %s", result.StatusCode, result.Error)
+	a.writeError(w, r, result.StatusCode, result.Error)
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeScopes returns the union of the principal and key scopes.
+func mergeScopes(principalScopes, keyScopes []string) []string {
+	if len(keyScopes) == 0 {
+		return principalScopes
+	}
+	merged := append([]string{}, principalScopes...)
+	for _, scope := range keyScopes {
+		if !containsScope(merged, scope) {
+			merged = append(merged, scope)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,331 @@
+package apikey
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidSignature = errors.New("invalid request signature")
+var ErrSignatureExpired = errors.New("request timestamp is outside the allowed clock skew")
+var ErrReplayedRequest = errors.New("request nonce has already been used")
+var ErrRequestBodyTooLarge = errors.New("signed request body is too large")
+var ErrUnreadableRequestBody = errors.New("signed request body could not be read")
+
+// SigningScheme is the Authorization scheme of signed requests:
+//
+//	Authorization: APIKey-HMAC-SHA256 keyId="<id>", timestamp="<unix seconds>",
+//	    nonce="<random>", headers="host;content-type", signature="<base64>"
+//
+// The signature is the HMAC-SHA256, keyed with the SHA-256 digest of the API
+// key, of these lines joined by newlines:
+//
+//	APIKey-HMAC-SHA256
+//	<timestamp>
+//	<nonce>
+//	<method>
+//	<escaped path>[?<raw query>]
+//	<name>:<trimmed value> for each signed header, in the order listed
+//	<hex SHA-256 digest of the body>
+//
+// The key itself never leaves the client. The server verifies the HMAC with
+// the key's SHA-256 digest, so signing works with keys stored in plaintext or
+// as sha256 digests, which must have an ID in the configuration. Since the
+// digest is all that is needed to sign, a sha256 digest in the configuration
+// is as sensitive as the key itself once signing is enabled. argon2id hashes
+// cannot be used, as the digest cannot be recovered from them.
+const SigningScheme = "APIKey-HMAC-SHA256"
+
+const (
+	defaultMaxClockSkew     = 5 * time.Minute
+	defaultMaxSignedBody    = 10 << 20
+	nonceCachePruneInterval = time.Minute
+)
+
+// SigningOptions configure verification of signed requests. The zero value
+// uses the defaults.
+type SigningOptions struct {
+	// MaxClockSkew is how far the signed timestamp may be from the server's
+	// clock. Defaults to five minutes.
+	MaxClockSkew time.Duration
+
+	// RequiredHeaders must be among the signed headers, e.g. "host".
+	RequiredHeaders []string
+
+	// Nonces remembers nonces to reject replays. Defaults to a
+	// MemoryNonceCache shared by all requests; use a shared store when a
+	// service runs multiple instances.
+	Nonces NonceCache
+
+	// MaxBodyBytes limits the body read to verify its digest. Defaults to 10
+	// MiB.
+	MaxBodyBytes int64
+
+	// RequireSignature rejects requests presenting a key any other way.
+	RequireSignature bool
+
+	defaultNonces     NonceCache
+	defaultNoncesOnce sync.Once
+}
+
+func (o *SigningOptions) maxClockSkew() time.Duration {
+	if o.MaxClockSkew > 0 {
+		return o.MaxClockSkew
+	}
+	return defaultMaxClockSkew
+}
+
+func (o *SigningOptions) maxBodyBytes() int64 {
+	if o.MaxBodyBytes > 0 {
+		return o.MaxBodyBytes
+	}
+	return defaultMaxSignedBody
+}
+
+func (o *SigningOptions) nonces() NonceCache {
+	if o.Nonces != nil {
+		return o.Nonces
+	}
+	o.defaultNoncesOnce.Do(func() { o.defaultNonces = NewMemoryNonceCache() })
+	return o.defaultNonces
+}
+
+// A NonceCache records the nonces of signed requests. Add returns false if
+// nonce was already added and has not yet expired.
+type NonceCache interface {
+	Add(ctx context.Context, nonce string, expires time.Time) (bool, error)
+}
+
+// MemoryNonceCache is a NonceCache that keeps nonces in memory, so each
+// instance of a service rejects replays separately.
+type MemoryNonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+func NewMemoryNonceCache() *MemoryNonceCache {
+	return &MemoryNonceCache{nonces: map[string]time.Time{}, now: time.Now}
+}
+
+func (c *MemoryNonceCache) Add(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if now.Sub(c.lastPrune) >= nonceCachePruneInterval {
+		for n, exp := range c.nonces {
+			if !now.Before(exp) {
+				delete(c.nonces, n)
+			}
+		}
+		c.lastPrune = now
+	}
+	if exp, ok := c.nonces[nonce]; ok && now.Before(exp) {
+		return false, nil
+	}
+	c.nonces[nonce] = expires
+	return true, nil
+}
+
+// signatureParams are the parameters of a signed Authorization header.
+type signatureParams struct {
+	keyID     string
+	timestamp string
+	nonce     string
+	headers   []string
+	signature []byte
+}
+
+// SignRequest signs req with the API key identified by keyID, covering the
+// named headers, which must already be set; "host" refers to req.Host. The
+// body is read and replaced so that it can still be sent.
+func SignRequest(req *http.Request, keyID, apiKey string, headers ...string) error {
+	return signRequest(req, keyID, apiKey, time.Now(), headers)
+}
+
+func signRequest(req *http.Request, keyID, apiKey string, now time.Time, headers []string) error {
+	body, err := readBody(req, -1)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to read random nonce: %w", err)
+	}
+	params := signatureParams{
+		keyID:     keyID,
+		timestamp: strconv.FormatInt(now.Unix(), 10),
+		nonce:     hex.EncodeToString(nonce),
+	}
+	for _, h := range headers {
+		params.headers = append(params.headers, strings.ToLower(h))
+	}
+	digest := sha256.Sum256([]byte(apiKey))
+	params.signature = sign(digest[:], stringToSign(req, params, body))
+	req.Header.Set("Authorization", fmt.Sprintf(`%s keyId=%q, timestamp=%q, nonce=%q, headers=%q, signature=%q`,
+		SigningScheme, params.keyID, params.timestamp, params.nonce, strings.Join(params.headers, ";"),
+		base64.StdEncoding.EncodeToString(params.signature)))
+	return nil
+}
+
+// validateSigned verifies a request with a signed Authorization header. ok is
+// false if the request is not signed and should be validated as usual.
+func (a *APIKey) validateSigned(req *http.Request) (result Result, ok bool) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, SigningScheme+" ") {
+		if a.Signing.RequireSignature && authHeader == "" {
+			return Result{Error: ErrAuthorizationRequired, StatusCode: http.StatusUnauthorized}, true
+		}
+		if a.Signing.RequireSignature {
+			return Result{Error: ErrInvalidAuthorizationHeader, StatusCode: http.StatusBadRequest}, true
+		}
+		return Result{}, false
+	}
+	params, err := parseSignatureParams(strings.TrimPrefix(authHeader, SigningScheme+" "))
+	if err != nil {
+		return Result{Error: ErrInvalidAuthorizationHeader, StatusCode: http.StatusBadRequest}, true
+	}
+	for _, required := range a.Signing.RequiredHeaders {
+		if !slices.Contains(params.headers, strings.ToLower(required)) {
+			return Result{Error: ErrInvalidAuthorizationHeader, StatusCode: http.StatusBadRequest}, true
+		}
+	}
+
+	now := time.Now()
+	timestamp, err := strconv.ParseInt(params.timestamp, 10, 64)
+	if err != nil {
+		return Result{Error: ErrInvalidAuthorizationHeader, StatusCode: http.StatusBadRequest}, true
+	}
+	skew := now.Sub(time.Unix(timestamp, 0))
+	if skew < -a.Signing.maxClockSkew() || skew > a.Signing.maxClockSkew() {
+		return Result{Error: ErrSignatureExpired, StatusCode: http.StatusUnauthorized}, true
+	}
+
+	match := a.keySet().byKeyID[params.keyID]
+	if match == nil {
+		return Result{Error: ErrInvalidAPIKey, StatusCode: http.StatusUnprocessableEntity}, true
+	}
+	body, err := readBody(req, a.Signing.maxBodyBytes())
+	if errors.Is(err, ErrRequestBodyTooLarge) {
+		return Result{Error: ErrRequestBodyTooLarge, StatusCode: http.StatusRequestEntityTooLarge}, true
+	}
+	if err != nil {
+		return Result{Error: ErrUnreadableRequestBody, StatusCode: http.StatusBadRequest}, true
+	}
+	// The HMAC key is the digest, which plaintext and sha256 keys both store.
+	signable := match.stored.scheme == schemePlaintext || match.stored.scheme == schemeSHA256
+	if !signable || !hmac.Equal(sign(match.stored.digest, stringToSign(req, params, body)), params.signature) {
+		return Result{Error: ErrInvalidSignature, StatusCode: http.StatusUnauthorized}, true
+	}
+
+	// Nonces are only recorded for genuine signatures, so they cannot be
+	// used up by forged requests.
+	fresh, err := a.Signing.nonces().Add(req.Context(), params.keyID+":"+params.nonce, now.Add(2*a.Signing.maxClockSkew()))
+	if err != nil {
+		log.Printf("apikey: failed to check request nonce for key %s: %s", params.keyID, err)
+		return Result{Error: errors.New("failed to check request nonce"), StatusCode: http.StatusInternalServerError}, true
+	}
+	if !fresh {
+		return Result{Error: ErrReplayedRequest, StatusCode: http.StatusUnauthorized}, true
+	}
+	return a.accept(req, match, now), true
+}
+
+func parseSignatureParams(s string) (signatureParams, error) {
+	values := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return signatureParams{}, fmt.Errorf("invalid signature parameter %q", part)
+		}
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return signatureParams{}, fmt.Errorf("invalid signature parameter %q: %w", name, err)
+		}
+		values[name] = unquoted
+	}
+	params := signatureParams{
+		keyID:     values["keyId"],
+		timestamp: values["timestamp"],
+		nonce:     values["nonce"],
+	}
+	if params.keyID == "" || params.timestamp == "" || params.nonce == "" || values["signature"] == "" {
+		return signatureParams{}, errors.New("keyId, timestamp, nonce and signature are required")
+	}
+	if values["headers"] != "" {
+		params.headers = strings.Split(strings.ToLower(values["headers"]), ";")
+	}
+	signature, err := base64.StdEncoding.DecodeString(values["signature"])
+	if err != nil {
+		return signatureParams{}, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	params.signature = signature
+	return params, nil
+}
+
+func stringToSign(req *http.Request, params signatureParams, body []byte) []byte {
+	var b strings.Builder
+	target := req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	bodyDigest := sha256.Sum256(body)
+	b.WriteString(SigningScheme + "\n" + params.timestamp + "\n" + params.nonce + "\n" + req.Method + "\n" + target + "\n")
+	for _, name := range params.headers {
+		value := req.Header.Get(name)
+		if name == "host" {
+			// Servers move the Host header to req.Host; clients may leave it
+			// empty to use the URL's host.
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		b.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	b.WriteString(hex.EncodeToString(bodyDigest[:]))
+	return []byte(b.String())
+}
+
+func sign(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// readBody reads the body of req, up to limit bytes if limit is not negative,
+// and replaces it so that it can be read again.
+func readBody(req *http.Request, limit int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	reader := io.Reader(req.Body)
+	if limit >= 0 {
+		reader = io.LimitReader(req.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error reading request body: %w", err)
+	}
+	if limit >= 0 && int64(len(body)) > limit {
+		return nil, ErrRequestBodyTooLarge
+	}
+	return body, nil
+}
@@ -0,0 +1,143 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestSignedRequests(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	argon2idKey, err := HashKeyArgon2id("4R60N2K3Y0123456")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signingAPI := &APIKey{
+		Config: []*APIKeyConfig{
+			{Principal: "signer", Keys: []Key{{ID: "signer-1", Value: "516N3RK3Y0123456"}, {ID: "sha256-1", Value: HashKey("5HA256K3Y0123456")}, {ID: "argon2id-1", Value: argon2idKey}}},
+		},
+		Signing: &SigningOptions{RequiredHeaders: []string{"Host"}},
+	}
+
+	newRequest := func(body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "https://api.example.com/reports?page=2", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+	signed := func(keyID, key string, headers ...string) *http.Request {
+		r := newRequest(`{"name":"q1"}`)
+		if err := SignRequest(r, keyID, key, headers...); err != nil {
+			t.Fatalf("unexpected error signing: %s", err)
+		}
+		return r
+	}
+
+	r := signed("signer-1", "516N3RK3Y0123456", "host", "content-type")
+	if result := signingAPI.Validate(r); !result.IsValid() || result.Principal != "signer" || result.KeyID != "signer-1" {
+		t.Fatalf("expected signed request to be valid, got status %d error %v", result.StatusCode, result.Error)
+	}
+	if result := signingAPI.Validate(r); result.Error != ErrReplayedRequest {
+		t.Errorf("expected replay to be rejected, got %v", result.Error)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"name":"q1"}` {
+		t.Errorf("expected body to remain readable, got %q", body)
+	}
+
+	tampered := map[string]func(*http.Request){
+		"Body":          func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"name":"q2"}`)) },
+		"Query":         func(r *http.Request) { r.URL.RawQuery = "page=3" },
+		"Method":        func(r *http.Request) { r.Method = http.MethodPut },
+		"Signed header": func(r *http.Request) { r.Header.Set("Content-Type", "text/plain") },
+	}
+	for name, tamper := range tampered {
+		r := signed("signer-1", "516N3RK3Y0123456", "host", "content-type")
+		tamper(r)
+		if result := signingAPI.Validate(r); result.Error != ErrInvalidSignature || result.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected ErrInvalidSignature, got status %d error %v", name, result.StatusCode, result.Error)
+		}
+	}
+
+	testCases := []struct {
+		Name           string
+		Request        *http.Request
+		ExpectedStatus int
+		ExpectedError  error
+	}{
+		{Name: "Wrong key", Request: signed("signer-1", "W40N6K3Y01234567", "host"), ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrInvalidSignature},
+		{Name: "Unknown key id", Request: signed("missing", "516N3RK3Y0123456", "host"), ExpectedStatus: http.StatusUnprocessableEntity, ExpectedError: ErrInvalidAPIKey},
+		{Name: "sha256 key", Request: signed("sha256-1", "5HA256K3Y0123456", "host"), ExpectedStatus: http.StatusOK},
+		{Name: "argon2id key", Request: signed("argon2id-1", "4R60N2K3Y0123456", "host"), ExpectedStatus: http.StatusUnauthorized, ExpectedError: ErrInvalidSignature},
+		{Name: "Required header not signed", Request: signed("signer-1", "516N3RK3Y0123456", "content-type"), ExpectedStatus: http.StatusBadRequest, ExpectedError: ErrInvalidAuthorizationHeader},
+		{
+			Name: "Stale timestamp",
+			Request: func() *http.Request {
+				r := newRequest("")
+				if err := signRequest(r, "signer-1", "516N3RK3Y0123456", time.Now().Add(-10*time.Minute), []string{"host"}); err != nil {
+					t.Fatalf("unexpected error signing: %s", err)
+				}
+				return r
+			}(),
+			ExpectedStatus: http.StatusUnauthorized,
+			ExpectedError:  ErrSignatureExpired,
+		},
+		{
+			Name: "Unreadable body",
+			Request: func() *http.Request {
+				r := signed("signer-1", "516N3RK3Y0123456", "host")
+				r.Body = io.NopCloser(iotest.ErrReader(errors.New("connection reset")))
+				return r
+			}(),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedError:  ErrUnreadableRequestBody,
+		},
+		{
+			Name: "Bearer still accepted",
+			Request: func() *http.Request {
+				r := newRequest("")
+				r.Header.Set("Authorization", "Bearer 516N3RK3Y0123456")
+				return r
+			}(),
+			ExpectedStatus: http.StatusOK,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			result := signingAPI.Validate(testCase.Request)
+			if result.StatusCode != testCase.ExpectedStatus || result.Error != testCase.ExpectedError {
+				t.Errorf("expected status %d error %v, got status %d error %v", testCase.ExpectedStatus, testCase.ExpectedError, result.StatusCode, result.Error)
+			}
+		})
+	}
+
+	limitedAPI := &APIKey{Config: signingAPI.Config, Signing: &SigningOptions{MaxBodyBytes: 4}}
+	if result := limitedAPI.Validate(signed("signer-1", "516N3RK3Y0123456", "host")); result.Error != ErrRequestBodyTooLarge || result.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected large body to be rejected with 413, got status %d error %v", result.StatusCode, result.Error)
+	}
+
+	failingAPI := &APIKey{Config: signingAPI.Config, Signing: &SigningOptions{Nonces: failingNonceCache{}}}
+	result := failingAPI.Validate(signed("signer-1", "516N3RK3Y0123456", "host"))
+	if result.StatusCode != http.StatusInternalServerError || strings.Contains(result.Error.Error(), "connection refused") {
+		t.Errorf("expected nonce store failure to be a generic 500, got status %d error %v", result.StatusCode, result.Error)
+	}
+
+	requiredAPI := &APIKey{Config: signingAPI.Config, Signing: &SigningOptions{RequireSignature: true}}
+	r = newRequest("")
+	r.Header.Set("Authorization", "Bearer 516N3RK3Y0123456")
+	if result := requiredAPI.Validate(r); result.Error != ErrInvalidAuthorizationHeader {
+		t.Errorf("expected bearer key to be rejected when signatures are required, got %v", result.Error)
+	}
+}
+
+type failingNonceCache struct{}
+
+func (failingNonceCache) Add(ctx context.Context, nonce string, expires time.Time) (bool, error) {
+	return false, errors.New("dial tcp 10.0.0.5:6379: connection refused")
+}
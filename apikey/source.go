@@ -0,0 +1,161 @@
+package apikey
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// A ConfigSource fetches a JSON configuration document for a SourceKeyStore.
+// String names the source in error messages.
+type ConfigSource interface {
+	Fetch(ctx context.Context) ([]byte, error)
+	String() string
+}
+
+// A VersionedSource reports a version for its document without fetching it,
+// letting ReloadingKeyStore skip unchanged documents cheaply. The version must
+// change whenever the document does. Sources that are not versioned are
+// fetched on every poll and compared by content.
+type VersionedSource interface {
+	ConfigSource
+	Version(ctx context.Context) (string, error)
+}
+
+// SSMAPI is the subset of *ssm.Client used by SSMSource.
+type SSMAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// SecretsManagerAPI is the subset of *secretsmanager.Client used by SecretsManagerSource.
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+}
+
+// EnvSource is the name of an environment variable holding the configuration.
+type EnvSource string
+
+func (s EnvSource) Fetch(ctx context.Context) ([]byte, error) {
+	value := strings.TrimSpace(os.Getenv(string(s)))
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s must be set", string(s))
+	}
+	return []byte(value), nil
+}
+
+func (s EnvSource) String() string {
+	return string(s)
+}
+
+// FileSource is the path of a file holding the configuration.
+type FileSource string
+
+func (s FileSource) Fetch(ctx context.Context) ([]byte, error) {
+	data, err := os.ReadFile(string(s))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", string(s), err)
+	}
+	return data, nil
+}
+
+// Version returns the modification time and size of the file.
+func (s FileSource) Version(ctx context.Context) (string, error) {
+	info, err := os.Stat(string(s))
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", string(s), err)
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+func (s FileSource) String() string {
+	return string(s)
+}
+
+// SSMSource fetches the configuration from an SSM parameter.
+type SSMSource struct {
+	Client SSMAPI
+	Name   string
+}
+
+func (s *SSMSource) Fetch(ctx context.Context) ([]byte, error) {
+	out, err := s.Client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(s.Name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", s, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return nil, fmt.Errorf("%s has no value", s)
+	}
+	return []byte(aws.ToString(out.Parameter.Value)), nil
+}
+
+// Version returns the parameter version. The value is not decrypted, so
+// polling does not call KMS.
+func (s *SSMSource) Version(ctx context.Context) (string, error) {
+	out, err := s.Client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(s.Name),
+		WithDecryption: aws.Bool(false),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", s, err)
+	}
+	if out.Parameter == nil {
+		return "", fmt.Errorf("%s has no value", s)
+	}
+	return strconv.FormatInt(out.Parameter.Version, 10), nil
+}
+
+func (s *SSMSource) String() string {
+	return "SSM parameter " + s.Name
+}
+
+// SecretsManagerSource fetches the configuration from the current version of
+// a Secrets Manager secret stored as a string.
+type SecretsManagerSource struct {
+	Client   SecretsManagerAPI
+	SecretID string
+}
+
+func (s *SecretsManagerSource) Fetch(ctx context.Context) ([]byte, error) {
+	out, err := s.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(s.SecretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", s, err)
+	}
+	if out.SecretString == nil {
+		return nil, fmt.Errorf("%s has no string value", s)
+	}
+	return []byte(aws.ToString(out.SecretString)), nil
+}
+
+// Version returns the ID of the version labelled AWSCURRENT.
+func (s *SecretsManagerSource) Version(ctx context.Context) (string, error) {
+	out, err := s.Client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(s.SecretID),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing %s: %w", s, err)
+	}
+	for versionID, stages := range out.VersionIdsToStages {
+		for _, stage := range stages {
+			if stage == "AWSCURRENT" {
+				return versionID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%s has no AWSCURRENT version", s)
+}
+
+func (s *SecretsManagerSource) String() string {
+	return "secret " + s.SecretID
+}
@@ -0,0 +1,253 @@
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// A KeyStore supplies the keys that APIKey validates against. KeySet is called
+// on every validation, so implementations must answer from memory.
+type KeyStore interface {
+	KeySet() *KeySet
+}
+
+// A KeySet is an immutable snapshot of API key configuration, prepared for
+// validation when it is created. A *KeySet is itself a KeyStore that always
+// returns the same keys.
+//
+// Keys stored in plaintext or as sha256 digests are indexed by digest, so a
+// lookup costs one hash and one map access however many keys are configured.
+// argon2id hashes cannot be indexed by digest; they are found by the key ID
+// embedded in a structured key, so a lookup hashes at most the keys sharing
+// that ID. argon2id keys without an ID never match.
+type KeySet struct {
+	config       *Config
+	keys         []compiledKey
+	byDigest     map[[sha256.Size]byte]*compiledKey
+	byKeyID      map[string]*compiledKey   // all keys with an ID
+	argon2idByID map[string][]*compiledKey // argon2id keys with an ID
+
+	certs         []compiledKey
+	byCertificate map[string]*compiledKey // see CertificateMatch.index
+}
+
+type compiledKey struct {
+	entry      *APIKeyConfig
+	key        Key
+	stored     storedKey
+	rateLimit  *RateLimit // the principal's limit, or the default
+	quota      *Quota     // the principal's quota, or the default
+	allowedIPs []netip.Prefix
+	cert       CertificateMatch // for certificates, whose key has only an ID and scopes
+}
+
+// NewKeySet prepares the principals in config for validation. The
+// configuration should already have been validated, e.g. by ParseConfigJSON;
+// keys that cannot be parsed never match. config must not be modified
+// afterwards.
+func NewKeySet(config []*APIKeyConfig) *KeySet {
+	return NewKeySetFromConfig(&Config{Principals: config})
+}
+
+// NewKeySetFromConfig is like NewKeySet, but also applies the settings of a
+// complete configuration document.
+func NewKeySetFromConfig(config *Config) *KeySet {
+	ks := &KeySet{
+		config:        config,
+		byDigest:      map[[sha256.Size]byte]*compiledKey{},
+		byKeyID:       map[string]*compiledKey{},
+		argon2idByID:  map[string][]*compiledKey{},
+		byCertificate: map[string]*compiledKey{},
+	}
+	for _, entry := range config.Principals {
+		rateLimit := entry.RateLimit
+		if rateLimit == nil {
+			rateLimit = config.DefaultRateLimit
+		}
+		quota := entry.Quota
+		if quota == nil {
+			quota = config.DefaultQuota
+		}
+		allowedIPs, err := parsePrefixes(entry.AllowedCIDRs)
+		if err != nil {
+			continue
+		}
+		for _, key := range entry.Keys {
+			stored, err := parseStoredKey(key.Value)
+			if err != nil {
+				continue
+			}
+			ks.keys = append(ks.keys, compiledKey{entry: entry, key: key, stored: stored, rateLimit: rateLimit, quota: quota, allowedIPs: allowedIPs})
+		}
+		for _, cert := range entry.Certificates {
+			if _, err := cert.index(); err != nil {
+				continue
+			}
+			key := Key{ID: cert.ID, Scopes: cert.Scopes}
+			ks.certs = append(ks.certs, compiledKey{entry: entry, key: key, cert: cert, rateLimit: rateLimit, quota: quota, allowedIPs: allowedIPs})
+		}
+	}
+	// Index only once ks.keys has stopped growing, so the pointers stay valid.
+	for i := range ks.keys {
+		k := &ks.keys[i]
+		if _, ok := ks.byKeyID[k.key.ID]; k.key.ID != "" && !ok {
+			ks.byKeyID[k.key.ID] = k
+		}
+		if k.stored.scheme == schemeArgon2id {
+			if k.key.ID != "" {
+				ks.argon2idByID[k.key.ID] = append(ks.argon2idByID[k.key.ID], k)
+			}
+			continue
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], k.stored.digest)
+		// As before indexing, the first principal configured with a key wins.
+		if _, ok := ks.byDigest[digest]; !ok {
+			ks.byDigest[digest] = k
+		}
+	}
+	for i := range ks.certs {
+		k := &ks.certs[i]
+		name, _ := k.cert.index()
+		if _, ok := ks.byCertificate[name]; !ok {
+			ks.byCertificate[name] = k
+		}
+	}
+	return ks
+}
+
+func (ks *KeySet) KeySet() *KeySet {
+	return ks
+}
+
+// Config returns the configuration the KeySet was created from.
+func (ks *KeySet) Config() *Config {
+	return ks.config
+}
+
+// lookup returns the configured key matching apiKey, or nil if there is none.
+func (ks *KeySet) lookup(apiKey string) *compiledKey {
+	digest := sha256.Sum256([]byte(apiKey))
+	if k, ok := ks.byDigest[digest]; ok && k.stored.matches(apiKey, digest) {
+		return k
+	}
+	if len(ks.argon2idByID) == 0 {
+		return nil
+	}
+
+	structured, err := ParseKey(apiKey)
+	if err != nil {
+		return nil
+	}
+	candidates := ks.argon2idByID[structured.ID]
+	// Every candidate is hashed, so the time taken does not depend on which
+	// of them matched.
+	var match *compiledKey
+	for _, k := range candidates {
+		if k.stored.matches(apiKey, digest) && match == nil {
+			match = k
+		}
+	}
+	return match
+}
+
+// SourceKeyStore is a KeyStore holding the configuration fetched from a
+// ConfigSource. Every fetch is validated with the same rules as
+// GetConfigFromEnvJSON.
+type SourceKeyStore struct {
+	source ConfigSource
+	keySet atomic.Pointer[KeySet]
+
+	mu      sync.Mutex // serializes loads
+	version string     // version of the document in use
+}
+
+// NewSourceKeyStore returns a SourceKeyStore after loading its initial
+// configuration from source.
+func NewSourceKeyStore(ctx context.Context, source ConfigSource) (*SourceKeyStore, error) {
+	s := &SourceKeyStore{source: source}
+	if err := s.Load(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewEnvKeyStore returns a SourceKeyStore loaded from the API_KEY_CONFIG
+// environment variable.
+func NewEnvKeyStore() (*SourceKeyStore, error) {
+	return NewSourceKeyStore(context.Background(), EnvSource(APIKeyEnvVarName))
+}
+
+// NewFileKeyStore returns a SourceKeyStore loaded from the JSON file at path.
+func NewFileKeyStore(path string) (*SourceKeyStore, error) {
+	return NewSourceKeyStore(context.Background(), FileSource(path))
+}
+
+// NewSSMKeyStore returns a SourceKeyStore loaded from the SSM parameter name,
+// which is decrypted if it is a SecureString.
+func NewSSMKeyStore(ctx context.Context, client SSMAPI, name string) (*SourceKeyStore, error) {
+	return NewSourceKeyStore(ctx, &SSMSource{Client: client, Name: name})
+}
+
+// NewSecretsManagerKeyStore returns a SourceKeyStore loaded from the current
+// version of the Secrets Manager secret secretID.
+func NewSecretsManagerKeyStore(ctx context.Context, client SecretsManagerAPI, secretID string) (*SourceKeyStore, error) {
+	return NewSourceKeyStore(ctx, &SecretsManagerSource{Client: client, SecretID: secretID})
+}
+
+func (s *SourceKeyStore) KeySet() *KeySet {
+	return s.keySet.Load()
+}
+
+// Load fetches and validates the configuration from the source. The keys in
+// use are replaced only if the new configuration is valid. As with
+// GetConfigFromEnvJSON, the error is of type ConfigErrors.
+func (s *SourceKeyStore) Load(ctx context.Context) error {
+	_, err := s.reload(ctx, true)
+	return err
+}
+
+// reload loads the configuration if its version differs from the one in use,
+// or unconditionally if force is set. It reports whether the keys in use were
+// replaced.
+func (s *SourceKeyStore) reload(ctx context.Context, force bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	versioned, isVersioned := s.source.(VersionedSource)
+	var version string
+	if isVersioned {
+		var err error
+		if version, err = versioned.Version(ctx); err != nil {
+			return false, ConfigErrors{errs: []error{err}}
+		}
+		if !force && version == s.version {
+			return false, nil
+		}
+	}
+
+	data, err := s.source.Fetch(ctx)
+	if err != nil {
+		return false, ConfigErrors{errs: []error{err}}
+	}
+	if !isVersioned {
+		// Without a version from the source, detect changes by content.
+		digest := sha256.Sum256(data)
+		version = hex.EncodeToString(digest[:])
+		if !force && version == s.version {
+			return false, nil
+		}
+	}
+
+	config, err := ParseConfigJSON(data, s.source.String())
+	if err != nil {
+		return false, err
+	}
+	s.keySet.Store(NewKeySetFromConfig(config))
+	s.version = version
+	return true, nil
+}
@@ -0,0 +1,337 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+const storeTestConfig = `[{"principal": "store-team","keys": ["5T0R3K3Y01234567"]}]`
+
+type fakeSSM struct {
+	value   string
+	version int64
+	err     error
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Name: params.Name, Value: aws.String(f.value), Version: f.version}}, nil
+}
+
+type fakeSecretsManager struct {
+	value     string
+	versionID string
+	err       error
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(f.value), VersionId: aws.String(f.versionID)}, nil
+}
+
+func (f *fakeSecretsManager) DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &secretsmanager.DescribeSecretOutput{VersionIdsToStages: map[string][]string{f.versionID: {"AWSCURRENT"}}}, nil
+}
+
+func TestKeyStores(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	validPath := filepath.Join(dir, "keys.json")
+	invalidPath := filepath.Join(dir, "invalid.json")
+	if err := os.WriteFile(validPath, []byte(storeTestConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(invalidPath, []byte(`[{"principal": "","keys": ["5T0R3K3Y01234567"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		Name          string
+		NewStore      func() (*SourceKeyStore, error)
+		ExpectedError string
+	}{
+		{
+			Name:     "File",
+			NewStore: func() (*SourceKeyStore, error) { return NewFileKeyStore(validPath) },
+		},
+		{
+			Name:          "File invalid configuration",
+			NewStore:      func() (*SourceKeyStore, error) { return NewFileKeyStore(invalidPath) },
+			ExpectedError: fmt.Sprintf("%s entry principal string cannot be empty", invalidPath),
+		},
+		{
+			Name: "SSM",
+			NewStore: func() (*SourceKeyStore, error) {
+				return NewSSMKeyStore(ctx, &fakeSSM{value: storeTestConfig}, "/app/api-keys")
+			},
+		},
+		{
+			Name: "SSM fetch failure",
+			NewStore: func() (*SourceKeyStore, error) {
+				return NewSSMKeyStore(ctx, &fakeSSM{err: errors.New("access denied")}, "/app/api-keys")
+			},
+			ExpectedError: "error fetching SSM parameter /app/api-keys: access denied",
+		},
+		{
+			Name: "Secrets Manager",
+			NewStore: func() (*SourceKeyStore, error) {
+				return NewSecretsManagerKeyStore(ctx, &fakeSecretsManager{value: storeTestConfig}, "app/api-keys")
+			},
+		},
+		{
+			Name: "Secrets Manager invalid configuration",
+			NewStore: func() (*SourceKeyStore, error) {
+				return NewSecretsManagerKeyStore(ctx, &fakeSecretsManager{value: `[{"principal": "store-team","keys": ["short"]}]`}, "app/api-keys")
+			},
+			ExpectedError: "secret app/api-keys key string length cannot be less that 16 characters for principal store-team",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(t *testing.T) {
+			store, err := testCase.NewStore()
+			if testCase.ExpectedError != "" {
+				if err == nil {
+					t.Fatalf("error expected %q but no error returned", testCase.ExpectedError)
+				}
+				if _, ok := err.(ConfigErrors); !ok {
+					t.Errorf("expected ConfigErrors but got %T", err)
+				}
+				if err.Error() != testCase.ExpectedError {
+					t.Errorf("error expected %q, error result %q", testCase.ExpectedError, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			storeAPI := &APIKey{Store: store}
+			req := &http.Request{Header: http.Header{"Authorization": []string{"Bearer 5T0R3K3Y01234567"}}}
+			if result := storeAPI.Validate(req); !result.IsValid() || result.Principal != "store-team" {
+				t.Errorf("expected valid key for store-team, got status %d principal %q", result.StatusCode, result.Principal)
+			}
+		})
+	}
+}
+
+func TestSourceKeyStoreKeepsConfigOnFailedLoad(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	ctx := context.Background()
+	source := &fakeSSM{value: storeTestConfig}
+	store, err := NewSSMKeyStore(ctx, source, "/app/api-keys")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	source.value = `not json`
+	if err := store.Load(ctx); err == nil {
+		t.Fatalf("expected Load to fail")
+	}
+	if config := store.KeySet().Config().Principals; len(config) != 1 || config[0].Principal != "store-team" {
+		t.Errorf("expected previous configuration to be kept, got %v", config)
+	}
+}
+
+func TestReloadingKeyStore(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var events []ReloadEvent
+	onReload := func(_ context.Context, event ReloadEvent) {
+		events = append(events, event)
+	}
+
+	validate := func(store KeyStore, key string) Result {
+		req := &http.Request{Header: http.Header{"Authorization": []string{"Bearer " + key}}}
+		return (&APIKey{Store: store}).Validate(req)
+	}
+
+	t.Run("Secrets Manager", func(t *testing.T) {
+		events = nil
+		client := &fakeSecretsManager{value: storeTestConfig, versionID: "v1"}
+		// A long interval keeps the background goroutine out of the way; polls are driven directly.
+		store, err := NewReloadingKeyStore(ctx, &SecretsManagerSource{Client: client, SecretID: "app/api-keys"}, time.Hour, onReload)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		store.poll(ctx)
+		if len(events) != 0 {
+			t.Fatalf("expected no events for an unchanged secret, got %v", events)
+		}
+
+		// A new version is swapped in.
+		client.value, client.versionID = `[{"principal": "rotated-team","keys": ["R07A73DK3Y012345"]}]`, "v2"
+		store.poll(ctx)
+		if len(events) != 1 || events[0].Err != nil {
+			t.Fatalf("expected one successful reload event, got %v", events)
+		}
+		if result := validate(store, "R07A73DK3Y012345"); result.Principal != "rotated-team" {
+			t.Errorf("expected rotated key to be valid, got status %d", result.StatusCode)
+		}
+		if result := validate(store, "5T0R3K3Y01234567"); result.IsValid() {
+			t.Errorf("expected old key to be invalid after reload")
+		}
+
+		// An invalid version is reported and the last good keys are kept.
+		client.value, client.versionID = `[{"principal": "","keys": []}]`, "v3"
+		store.poll(ctx)
+		if len(events) != 2 || events[1].Err == nil {
+			t.Fatalf("expected a failed reload event, got %v", events)
+		}
+		if result := validate(store, "R07A73DK3Y012345"); !result.IsValid() {
+			t.Errorf("expected last good keys to remain in use, got status %d", result.StatusCode)
+		}
+	})
+
+	t.Run("Unversioned source", func(t *testing.T) {
+		events = nil
+		os.Setenv("API_KEY_RELOAD_TEST", storeTestConfig)
+		defer os.Unsetenv("API_KEY_RELOAD_TEST")
+		store, err := NewReloadingKeyStore(ctx, EnvSource("API_KEY_RELOAD_TEST"), time.Hour, onReload)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		store.poll(ctx)
+		if len(events) != 0 {
+			t.Fatalf("expected no events for unchanged content, got %v", events)
+		}
+		os.Setenv("API_KEY_RELOAD_TEST", `[{"principal": "rotated-team","keys": ["R07A73DK3Y012345"]}]`)
+		store.poll(ctx)
+		if len(events) != 1 || events[0].Err != nil {
+			t.Fatalf("expected one successful reload event, got %v", events)
+		}
+	})
+}
+
+func TestKeySetLookup(t *testing.T) {
+	structured, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	argon2idStructured, err := HashKeyArgon2id(structured.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	argon2idPlain, err := HashKeyArgon2id("4R60N2K3Y0123456")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ks := NewKeySet([]*APIKeyConfig{
+		{Principal: "first", Keys: []Key{{Value: "DUP11C473K3Y0123"}, {Value: HashKey("5HA256K3Y0123456")}}},
+		{Principal: "second", Keys: []Key{{Value: HashKey("DUP11C473K3Y0123")}}},
+		{Principal: "argon2id", Keys: []Key{{ID: structured.ID, Value: argon2idStructured}, {Value: argon2idPlain}}},
+	})
+
+	testCases := []struct {
+		Key               string
+		ExpectedPrincipal string
+	}{
+		{Key: "5HA256K3Y0123456", ExpectedPrincipal: "first"},
+		{Key: "DUP11C473K3Y0123", ExpectedPrincipal: "first"},
+		{Key: structured.String(), ExpectedPrincipal: "argon2id"},
+		{Key: "4R60N2K3Y0123456"},
+		{Key: "UNKN0WNK3Y012345"},
+	}
+	for _, testCase := range testCases {
+		match := ks.lookup(testCase.Key)
+		principal := ""
+		if match != nil {
+			principal = match.entry.Principal
+		}
+		if principal != testCase.ExpectedPrincipal {
+			t.Errorf("%s: expected principal %q but got %q", testCase.Key, testCase.ExpectedPrincipal, principal)
+		}
+	}
+}
+
+func BenchmarkValidate(b *testing.B) {
+	log.SetOutput(ioutil.Discard)
+	const principals, keysPerPrincipal = 1000, 5
+	config := make([]*APIKeyConfig, principals)
+	var first, last string
+	for i := range config {
+		entry := &APIKeyConfig{Principal: fmt.Sprintf("partner-%d", i)}
+		for j := 0; j < keysPerPrincipal; j++ {
+			key, err := GenerateKey()
+			if err != nil {
+				b.Fatal(err)
+			}
+			entry.Keys = append(entry.Keys, Key{ID: key.ID, Value: HashKey(key.String())})
+			if first == "" {
+				first = key.String()
+			}
+			last = key.String()
+		}
+		config[i] = entry
+	}
+	// Hashing every argon2id key at startup would dominate the benchmark, so
+	// they share one hash; only the key IDs differ.
+	const argon2idKeys = 100
+	argon2idKey, err := GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	argon2idHash, err := HashKeyArgon2id(argon2idKey.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	argon2idEntry := &APIKeyConfig{Principal: "argon2id", Keys: []Key{{ID: argon2idKey.ID, Value: argon2idHash}}}
+	for i := 1; i < argon2idKeys; i++ {
+		key, err := GenerateKey()
+		if err != nil {
+			b.Fatal(err)
+		}
+		argon2idEntry.Keys = append(argon2idEntry.Keys, Key{ID: key.ID, Value: argon2idHash})
+	}
+	unknown, err := GenerateKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchAPI := &APIKey{Config: config}
+	argon2idAPI := &APIKey{Config: append(config[:len(config):len(config)], argon2idEntry)}
+
+	for _, bench := range []struct {
+		Name string
+		API  *APIKey
+		Key  string
+	}{
+		{Name: "First key", API: benchAPI, Key: first},
+		{Name: "Last key", API: benchAPI, Key: last},
+		{Name: "Unknown key", API: benchAPI, Key: unknown.String()},
+		{Name: "argon2id key", API: argon2idAPI, Key: argon2idKey.String()},
+		{Name: "Unknown key with argon2id keys", API: argon2idAPI, Key: unknown.String()},
+	} {
+		req := &http.Request{Header: http.Header{"Authorization": []string{"Bearer " + bench.Key}}}
+		b.Run(bench.Name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bench.API.Validate(req)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package apikey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+var ErrInvalidAccessToken = errors.New("invalid access token")
+var ErrAccessTokenExpired = errors.New("access token has expired")
+var ErrTokenRequiresKeyID = errors.New("only API keys with an id can be exchanged for access tokens")
+
+const (
+	defaultTokenIssuer = "apikey"
+	defaultTokenTTL    = time.Hour
+	tokenLeeway        = time.Minute // allowed clock skew between instances
+)
+
+// TokenOptions configure the access tokens issued by APIKey.TokenHandler,
+// which are accepted in place of API keys when APIKey.Tokens is set.
+type TokenOptions struct {
+	Keys     TokenKeys
+	Issuer   string        // iss claim, defaults to "apikey"
+	Audience string        // aud claim, set to keep services sharing Keys from accepting each other's tokens
+	TTL      time.Duration // defaults to one hour
+}
+
+func (o *TokenOptions) issuer() string {
+	if o.Issuer == "" {
+		return defaultTokenIssuer
+	}
+	return o.Issuer
+}
+
+func (o *TokenOptions) ttl() time.Duration {
+	if o.TTL <= 0 {
+		return defaultTokenTTL
+	}
+	return o.TTL
+}
+
+// TokenKey is an ECDSA P-256 key that signs access tokens with ES256. ID is
+// sent as the kid header of its tokens and must be unique among the keys in
+// use.
+type TokenKey struct {
+	ID  string
+	Key *ecdsa.PrivateKey
+}
+
+// GenerateTokenKey returns a new TokenKey with a random ID.
+func GenerateTokenKey() (TokenKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return TokenKey{}, fmt.Errorf("failed to generate token key: %w", err)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return TokenKey{}, fmt.Errorf("failed to read random key id: %w", err)
+	}
+	return TokenKey{ID: hex.EncodeToString(id), Key: key}, nil
+}
+
+// TokenKeys supply the key that signs new access tokens and the keys whose
+// tokens are accepted, by ID.
+type TokenKeys interface {
+	SigningKey() TokenKey
+	VerificationKey(id string) (*ecdsa.PublicKey, bool)
+}
+
+// StaticTokenKeys sign with the first key and accept tokens signed by any of
+// them. To rotate keys shared by several instances of a service, append the
+// new key and deploy; then move it to the front and deploy; and once the
+// tokens signed by the old key have expired, remove it.
+type StaticTokenKeys []TokenKey
+
+func (keys StaticTokenKeys) SigningKey() TokenKey {
+	return keys[0]
+}
+
+func (keys StaticTokenKeys) VerificationKey(id string) (*ecdsa.PublicKey, bool) {
+	for _, key := range keys {
+		if key.ID == id {
+			return &key.Key.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// RotatingTokenKeys generate a new signing key every interval and accept
+// tokens signed by a retired key for retain longer. Tokens outlive their key
+// if retain is shorter than the TTL of the tokens, and are then rejected
+// before they expire; TokenHandler logs a warning when that is the case. The
+// keys never leave memory, so each instance of a service only accepts the
+// tokens it issued; use StaticTokenKeys when requests are spread over several
+// instances.
+type RotatingTokenKeys struct {
+	mu       sync.Mutex
+	keys     []rotatingKey // newest first
+	interval time.Duration
+	retain   time.Duration
+	now      func() time.Time
+}
+
+type rotatingKey struct {
+	TokenKey
+	created time.Time
+}
+
+// NewRotatingTokenKeys returns RotatingTokenKeys with a first signing key.
+// interval and retain must be positive.
+func NewRotatingTokenKeys(interval, retain time.Duration) (*RotatingTokenKeys, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("token key rotation interval must be positive, got %s", interval)
+	}
+	if retain <= 0 {
+		return nil, fmt.Errorf("token key retention must be positive, got %s", retain)
+	}
+	key, err := GenerateTokenKey()
+	if err != nil {
+		return nil, err
+	}
+	k := &RotatingTokenKeys{interval: interval, retain: retain, now: time.Now}
+	k.keys = []rotatingKey{{TokenKey: key, created: k.now()}}
+	return k, nil
+}
+
+func (k *RotatingTokenKeys) SigningKey() TokenKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := k.now()
+	if now.Sub(k.keys[0].created) >= k.interval {
+		key, err := GenerateTokenKey()
+		if err != nil {
+			log.Printf("apikey: failed to rotate token key, still signing with %s: %s", k.keys[0].ID, err)
+			return k.keys[0].TokenKey
+		}
+		k.keys = append([]rotatingKey{{TokenKey: key, created: now}}, k.keys...)
+	}
+	// A key stops signing when the next one is created.
+	for i := 1; i < len(k.keys); i++ {
+		if now.Sub(k.keys[i-1].created) >= k.retain {
+			k.keys = k.keys[:i]
+			break
+		}
+	}
+	return k.keys[0].TokenKey
+}
+
+func (k *RotatingTokenKeys) VerificationKey(id string) (*ecdsa.PublicKey, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range k.keys {
+		if key.ID == id {
+			return &key.Key.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+type tokenClaims struct {
+	jwt.Claims
+	KeyID string `json:"key_id"`
+	Scope string `json:"scope,omitempty"`
+}
+
+// TokenResponse is the body of a successful response from TokenHandler, as
+// defined for OAuth 2.0 by RFC 6749.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// TokenHandler exchanges the API key of a POST request for an access token
+// signed with a.Tokens, which must be set, see TokenResponse. An optional
+// scope form parameter lists the scopes wanted, separated by spaces;
+// otherwise the token carries all of the key's scopes. Only keys with an ID
+// can be exchanged, and access tokens cannot be exchanged for new ones.
+//
+// Serve it behind ValidateHandlerWithOptions, not as a public path, so that
+// the FailureTracker and RateLimiter apply to key guesses against it; the
+// handler uses the Result stored in the request context by the middleware,
+// and only validates the key itself when there is none.
+func (a *APIKey) TokenHandler() http.Handler {
+	if keys, ok := a.Tokens.Keys.(*RotatingTokenKeys); ok && keys.retain < a.Tokens.ttl() {
+		log.Printf("apikey: token keys are retained for %s, less than the token TTL of %s; tokens will be rejected before they expire", keys.retain, a.Tokens.ttl())
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			a.writeError(w, r, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		result, ok := ResultFromContext(r.Context())
+		if !ok {
+			result = a.Validate(r)
+		}
+		if result.IsValid() && (result.accessToken || a.keySet().byKeyID[result.KeyID] == nil) {
+			result.StatusCode, result.Error = http.StatusBadRequest, ErrTokenRequiresKeyID
+		}
+		if !result.IsValid() {
+			a.rejectInvalid(w, r, result)
+			return
+		}
+
+		scopes := result.Scopes
+		if requested := r.PostFormValue("scope"); requested != "" {
+			scopes = strings.Fields(requested)
+			if result := a.checkScopes(r, result, scopes); !result.IsValid() {
+				a.writeError(w, r, result.StatusCode, result.Error)
+				return
+			}
+		}
+		token, err := a.issueToken(result, scopes, time.Now())
+		if err != nil {
+			log.Printf("apikey: failed to issue access token for principal %s: %s", result.Principal, err)
+			a.writeError(w, r, http.StatusInternalServerError, errors.New("failed to issue access token"))
+			return
+		}
+		if result.Deprecated {
+			w.Header().Set("Warning", deprecatedKeyWarning)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, http.StatusOK, TokenResponse{
+			AccessToken: token,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(a.Tokens.ttl().Seconds()),
+			Scope:       strings.Join(scopes, " "),
+		})
+	})
+}
+
+func (a *APIKey) issueToken(result Result, scopes []string, now time.Time) (string, error) {
+	key := a.Tokens.Keys.SigningKey()
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: jose.JSONWebKey{Key: key.Key, KeyID: key.ID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", err
+	}
+	claims := tokenClaims{
+		Claims: jwt.Claims{
+			Issuer:    a.Tokens.issuer(),
+			Subject:   result.Principal,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(a.Tokens.ttl())),
+		},
+		KeyID: result.KeyID,
+		Scope: strings.Join(scopes, " "),
+	}
+	if a.Tokens.Audience != "" {
+		claims.Audience = jwt.Audience{a.Tokens.Audience}
+	}
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
+
+// isAccessToken reports whether a presented credential looks like a JWT
+// rather than an API key.
+func isAccessToken(credential string) bool {
+	return strings.HasPrefix(credential, "eyJ") && strings.Count(credential, ".") == 2
+}
+
+// validateToken verifies an access token and checks the key it was issued
+// for, so revoking the key or changing the principal's restrictions applies
+// to its tokens too. The scopes are those of the token that the key still
+// has.
+func (a *APIKey) validateToken(req *http.Request, token string, now time.Time) Result {
+	invalid := Result{Error: ErrInvalidAccessToken, StatusCode: http.StatusUnauthorized}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil || len(parsed.Headers) != 1 || parsed.Headers[0].Algorithm != string(jose.ES256) {
+		return invalid
+	}
+	key, ok := a.Tokens.Keys.VerificationKey(parsed.Headers[0].KeyID)
+	if !ok {
+		return invalid
+	}
+	var claims tokenClaims
+	if err := parsed.Claims(key, &claims); err != nil {
+		return invalid
+	}
+	expected := jwt.Expected{Issuer: a.Tokens.issuer(), Time: now}
+	if a.Tokens.Audience != "" {
+		expected.Audience = jwt.Audience{a.Tokens.Audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, tokenLeeway); err != nil {
+		if errors.Is(err, jwt.ErrExpired) {
+			return Result{Principal: claims.Subject, KeyID: claims.KeyID, Error: ErrAccessTokenExpired, StatusCode: http.StatusUnauthorized}
+		}
+		return invalid
+	}
+
+	match := a.keySet().byKeyID[claims.KeyID]
+	if match == nil || match.entry.Principal != claims.Subject {
+		return invalid
+	}
+	result := a.accept(req, match, now)
+	if result.IsValid() {
+		var scopes []string
+		for _, scope := range strings.Fields(claims.Scope) {
+			if containsScope(result.Scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		result.Scopes = scopes
+		result.accessToken = true
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package apikey
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingTokenKeys(t *testing.T) {
+	keys, err := NewRotatingTokenKeys(time.Hour, 90*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	now := keys.keys[0].created
+	keys.now = func() time.Time { return now }
+
+	first := keys.SigningKey()
+	now = now.Add(time.Hour)
+	second := keys.SigningKey()
+	if second.ID == first.ID {
+		t.Fatalf("expected a new signing key after the interval")
+	}
+	if _, ok := keys.VerificationKey(first.ID); !ok {
+		t.Errorf("expected retired key to verify tokens while retained")
+	}
+	now = now.Add(90 * time.Minute)
+	third := keys.SigningKey()
+	if _, ok := keys.VerificationKey(first.ID); ok {
+		t.Errorf("expected retired key to be dropped after retain")
+	}
+	if _, ok := keys.VerificationKey(second.ID); !ok || third.ID == second.ID {
+		t.Errorf("expected the previous key to still verify tokens")
+	}
+
+	for _, durations := range [][2]time.Duration{{0, time.Hour}, {time.Hour, 0}, {-time.Hour, time.Hour}} {
+		if _, err := NewRotatingTokenKeys(durations[0], durations[1]); err == nil {
+			t.Errorf("expected error for interval %s and retain %s", durations[0], durations[1])
+		}
+	}
+}
+
+func TestTokenExchange(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	config, err := ParseConfigJSON([]byte(`[
+		{"principal": "partner", "scopes": ["reports:read", "reports:write"], "keys": [
+			{"id": "partner-1", "key": "P4R7N3RK3Y012345"},
+			{"id": "partner-2", "key": "R3V0K3DK3Y012345", "status": "revoked"}
+		]},
+		{"principal": "legacy", "keys": ["L3G4CYK3Y0123456"]}
+	]`), "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signingKey, err := GenerateTokenKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tokenAPI := &APIKey{Config: config.Principals, Tokens: &TokenOptions{Keys: StaticTokenKeys{signingKey}, Audience: "reports"}}
+	tracker := NewFailureTracker(2, time.Minute, time.Minute)
+	tokenHandler := tokenAPI.ValidateHandlerWithOptions(tokenAPI.TokenHandler(), HandlerOptions{FailureTracker: tracker})
+
+	exchange := func(method, credential, scope string) *httptest.ResponseRecorder {
+		form := url.Values{}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+		r := httptest.NewRequest(method, "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer "+credential)
+		w := httptest.NewRecorder()
+		tokenHandler.ServeHTTP(w, r)
+		return w
+	}
+	validate := func(api *APIKey, token string) Result {
+		r := httptest.NewRequest(http.MethodGet, testURL, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return api.Validate(r)
+	}
+
+	w := exchange(http.MethodPost, "P4R7N3RK3Y012345", "")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("expected token response, got %d %s", w.Code, w.Body)
+	}
+	var response TokenResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if response.TokenType != "Bearer" || response.ExpiresIn != 3600 || response.Scope != "reports:read reports:write" {
+		t.Errorf("unexpected token response %+v", response)
+	}
+	if result := validate(tokenAPI, response.AccessToken); !result.IsValid() || result.Principal != "partner" || result.KeyID != "partner-1" || !result.HasScopes("reports:read", "reports:write") {
+		t.Errorf("expected access token to validate as partner-1, got %+v", result)
+	}
+
+	w = exchange(http.MethodPost, "P4R7N3RK3Y012345", "reports:read")
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result := validate(tokenAPI, response.AccessToken); !result.IsValid() || !result.HasScopes("reports:read") || result.HasScopes("reports:write") {
+		t.Errorf("expected access token narrowed to reports:read, got %v", result.Scopes)
+	}
+
+	tests := []struct {
+		Name           string
+		Method         string
+		Credential     string
+		Scope          string
+		ExpectedStatus int
+	}{
+		{Name: "GET", Method: http.MethodGet, Credential: "P4R7N3RK3Y012345", ExpectedStatus: http.StatusMethodNotAllowed},
+		{Name: "Unknown key", Method: http.MethodPost, Credential: "UNKN0WNK3Y012345", ExpectedStatus: http.StatusUnprocessableEntity},
+		{Name: "Key without ID", Method: http.MethodPost, Credential: "L3G4CYK3Y0123456", ExpectedStatus: http.StatusBadRequest},
+		{Name: "Access token", Method: http.MethodPost, Credential: response.AccessToken, ExpectedStatus: http.StatusBadRequest},
+		{Name: "Scope not granted", Method: http.MethodPost, Credential: "P4R7N3RK3Y012345", Scope: "admin", ExpectedStatus: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if w := exchange(test.Method, test.Credential, test.Scope); w.Code != test.ExpectedStatus {
+			t.Errorf("%s: expected status %d but got %d", test.Name, test.ExpectedStatus, w.Code)
+		}
+	}
+
+	// Guesses against the token endpoint count towards the lockout.
+	exchange(http.MethodPost, "UNKN0WNK3Y012345", "")
+	if w := exchange(http.MethodPost, "P4R7N3RK3Y012345", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected locked out client to get 429, got %d", w.Code)
+	}
+
+	now := time.Now()
+	partner := Result{Principal: "partner", KeyID: "partner-1"}
+	issue := func(api *APIKey, result Result, at time.Time) string {
+		token, err := api.issueToken(result, []string{"reports:read"}, at)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return token
+	}
+	otherKey, err := GenerateTokenKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	otherSigner := &APIKey{Config: config.Principals, Tokens: &TokenOptions{Keys: StaticTokenKeys{otherKey}, Audience: "reports"}}
+	otherAudience := &APIKey{Config: config.Principals, Tokens: &TokenOptions{Keys: StaticTokenKeys{signingKey}, Audience: "billing"}}
+	rotated := &APIKey{Config: config.Principals, Tokens: &TokenOptions{Keys: StaticTokenKeys{otherKey, signingKey}, Audience: "reports"}}
+
+	tokenTests := []struct {
+		Name          string
+		API           *APIKey
+		Token         string
+		ExpectedError error
+	}{
+		{Name: "Expired", API: tokenAPI, Token: issue(tokenAPI, partner, now.Add(-2*time.Hour)), ExpectedError: ErrAccessTokenExpired},
+		{Name: "Unknown signing key", API: tokenAPI, Token: issue(otherSigner, partner, now), ExpectedError: ErrInvalidAccessToken},
+		{Name: "Other audience", API: otherAudience, Token: issue(tokenAPI, partner, now), ExpectedError: ErrInvalidAccessToken},
+		{Name: "Signed by previous key", API: rotated, Token: issue(tokenAPI, partner, now)},
+		{Name: "Revoked key", API: tokenAPI, Token: issue(tokenAPI, Result{Principal: "partner", KeyID: "partner-2"}, now), ExpectedError: ErrAPIKeyRevoked},
+		{Name: "Principal mismatch", API: tokenAPI, Token: issue(tokenAPI, Result{Principal: "legacy", KeyID: "partner-1"}, now), ExpectedError: ErrInvalidAccessToken},
+		{Name: "Tampered", API: tokenAPI, Token: issue(tokenAPI, partner, now) + "x", ExpectedError: ErrInvalidAccessToken},
+		{Name: "Tokens disabled", API: &APIKey{Config: config.Principals}, Token: issue(tokenAPI, partner, now), ExpectedError: ErrInvalidAPIKey},
+	}
+	for _, test := range tokenTests {
+		if result := validate(test.API, test.Token); result.Error != test.ExpectedError {
+			t.Errorf("%s: expected error %v but got %v", test.Name, test.ExpectedError, result.Error)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A WritableKeyStore is a KeyStore whose keys can be managed at runtime, for
+// example through AdminHandler. Changes must be visible to KeySet as soon as
+// the method returns.
+type WritableKeyStore interface {
+	KeyStore
+	// AddKey adds key to principal, creating the principal if needed. The
+	// key must have an ID that is not yet in use and a hashed Value.
+	AddKey(ctx context.Context, principal string, key Key) error
+	// Revoke marks the key keyID as revoked, returning ErrKeyNotFound if
+	// there is no such key.
+	Revoke(ctx context.Context, keyID string) error
+	// LastUsed returns the time each key was last used, by key ID. Keys
+	// that have not been used are omitted.
+	LastUsed(ctx context.Context) (map[string]time.Time, error)
+}
+
+// MemoryKeyStore is a WritableKeyStore that keeps its keys and usage in
+// memory, so changes are lost on restart.
+type MemoryKeyStore struct {
+	keySet atomic.Pointer[KeySet]
+
+	mu      sync.Mutex // serializes writes
+	source  string
+	persist func(*Config) error // called with the new configuration before it is used
+
+	usageMu sync.Mutex
+	usage   map[string]time.Time
+}
+
+// NewMemoryKeyStore returns a MemoryKeyStore holding config, which is
+// validated like a configuration document and must not be modified
+// afterwards. A nil config starts the store empty.
+func NewMemoryKeyStore(config *Config) (*MemoryKeyStore, error) {
+	return newMemoryKeyStore(config, "memory key store", nil)
+}
+
+func newMemoryKeyStore(config *Config, source string, persist func(*Config) error) (*MemoryKeyStore, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if err := validateConfig(config, source); err != nil {
+		return nil, err
+	}
+	s := &MemoryKeyStore{source: source, persist: persist, usage: map[string]time.Time{}}
+	s.keySet.Store(NewKeySetFromConfig(config))
+	return s, nil
+}
+
+func (s *MemoryKeyStore) KeySet() *KeySet {
+	return s.keySet.Load()
+}
+
+func (s *MemoryKeyStore) AddKey(ctx context.Context, principal string, key Key) error {
+	if key.ID == "" {
+		return fmt.Errorf("%s key id cannot be empty for principal %s", s.source, principal)
+	}
+	if !IsHashedKey(key.Value) {
+		return fmt.Errorf("%s key must be hashed for principal %s", s.source, principal)
+	}
+	return s.update(func(config *Config) error {
+		for _, entry := range config.Principals {
+			if entry.Principal == principal {
+				entry.Keys = append(entry.Keys, key)
+				return nil
+			}
+		}
+		config.Principals = append(config.Principals, &APIKeyConfig{Principal: principal, Keys: []Key{key}})
+		return nil
+	})
+}
+
+func (s *MemoryKeyStore) Revoke(ctx context.Context, keyID string) error {
+	return s.update(func(config *Config) error {
+		for _, entry := range config.Principals {
+			for i := range entry.Keys {
+				if entry.Keys[i].ID == keyID {
+					entry.Keys[i].Status = KeyStatusRevoked
+					return nil
+				}
+			}
+		}
+		return ErrKeyNotFound
+	})
+}
+
+// update applies change to a copy of the configuration and, if the result is
+// valid and persisted, puts it in use.
+func (s *MemoryKeyStore) update(change func(*Config) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	config := cloneConfig(s.keySet.Load().Config())
+	if err := change(config); err != nil {
+		return err
+	}
+	if err := validateConfig(config, s.source); err != nil {
+		return err
+	}
+	if s.persist != nil {
+		if err := s.persist(config); err != nil {
+			return err
+		}
+	}
+	s.keySet.Store(NewKeySetFromConfig(config))
+	return nil
+}
+
+// cloneConfig copies config deeply enough for principals and their keys to
+// be changed without affecting KeySets built from the original.
+func cloneConfig(config *Config) *Config {
+	clone := &Config{DefaultRateLimit: config.DefaultRateLimit, DefaultQuota: config.DefaultQuota}
+	for _, entry := range config.Principals {
+		entryClone := *entry
+		entryClone.Keys = append([]Key(nil), entry.Keys...)
+		clone.Principals = append(clone.Principals, &entryClone)
+	}
+	return clone
+}
+
+func (s *MemoryKeyStore) RecordUsage(keyID string, at time.Time) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if last, ok := s.usage[keyID]; !ok || at.After(last) {
+		s.usage[keyID] = at
+	}
+}
+
+func (s *MemoryKeyStore) LastUsed(ctx context.Context) (map[string]time.Time, error) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	usage := make(map[string]time.Time, len(s.usage))
+	for id, at := range s.usage {
+		usage[id] = at
+	}
+	return usage, nil
+}
+
+// JSONFileKeyStore is a WritableKeyStore that saves every change to a JSON
+// configuration file, in the format read by NewFileKeyStore. Usage is kept in
+// memory only.
+type JSONFileKeyStore struct {
+	*MemoryKeyStore
+	path string
+}
+
+// NewJSONFileKeyStore loads the configuration file at path. The file is
+// created on the first change if it does not exist.
+func NewJSONFileKeyStore(path string) (*JSONFileKeyStore, error) {
+	config := &Config{}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, ConfigErrors{errs: []error{fmt.Errorf("error reading %s: %w", path, err)}}
+	default:
+		if config, err = ParseConfigJSON(data, path); err != nil {
+			return nil, err
+		}
+	}
+	s := &JSONFileKeyStore{path: path}
+	if s.MemoryKeyStore, err = newMemoryKeyStore(config, path, s.save); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// save writes config to a temporary file and renames it over the original, so
+// readers never see a partial file.
+func (s *JSONFileKeyStore) save(config *Config) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", s.path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing %s: %w", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package authn
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/corbaltcode/go-libraries/apikey"
+)
+
+// APIKeyAuthenticator authenticates requests with APIKey.Validate. Unknown
+// and malformed keys are rejected with 401 Unauthorized rather than 422, like
+// the other methods' invalid credentials. As a Preparer, it does what the
+// apikey middleware does for valid keys, see APIKey.WithResult.
+type APIKeyAuthenticator struct {
+	APIKey *apikey.APIKey
+
+	// Options apply a FailureTracker, RateLimiter and QuotaCounter as
+	// APIKey.ValidateHandlerWithOptions does, rejecting requests with the
+	// same 429 Too Many Requests responses. Public paths are not used.
+	Options apikey.HandlerOptions
+}
+
+func (a APIKeyAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	var result apikey.Result
+	if tracker := a.Options.FailureTracker; tracker != nil {
+		result = a.APIKey.ValidateTracked(r, tracker)
+		if errors.Is(result.Error, apikey.ErrTooManyFailedAttempts) {
+			until, _ := tracker.LockedOut(a.APIKey.ClientIP(r))
+			header := http.Header{"Retry-After": []string{strconv.Itoa(int(math.Ceil(time.Until(until).Seconds())))}}
+			return Identity{}, &Error{StatusCode: result.StatusCode, Err: result.Error, Header: header}
+		}
+	} else {
+		result = a.APIKey.Validate(r)
+	}
+	if errors.Is(result.Error, apikey.ErrAuthorizationRequired) {
+		return Identity{}, ErrNoCredentials
+	}
+	if !result.IsValid() {
+		status := result.StatusCode
+		if status == http.StatusUnprocessableEntity {
+			status = http.StatusUnauthorized
+		}
+		return Identity{}, &Error{StatusCode: status, Err: result.Error}
+	}
+	return Identity{Principal: result.Principal, Source: SourceAPIKey, Scopes: result.Scopes, apiKeyResult: &result}, nil
+}
+
+func (a APIKeyAuthenticator) Prepare(w http.ResponseWriter, r *http.Request, identity Identity) (*http.Request, error) {
+	if identity.apiKeyResult == nil {
+		return r, nil
+	}
+	r = a.APIKey.WithResult(w, r, *identity.apiKeyResult)
+	if err := a.APIKey.Allow(w, r, a.Options); err != nil {
+		return nil, &Error{StatusCode: http.StatusTooManyRequests, Err: err}
+	}
+	return r, nil
+}
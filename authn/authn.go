@@ -0,0 +1,219 @@
+// Package authn authenticates requests with any of several methods, such as
+// API keys and Azure AD tokens, and gives handlers one Identity to work with.
+package authn
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/corbaltcode/go-libraries/apikey"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// none of the credentials it accepts, so that the next one is tried.
+var ErrNoCredentials = errors.New("no credentials for this authenticator")
+
+// Sources of an Identity.
+const (
+	SourceAPIKey  = "apikey"
+	SourceAzureAD = "azuread"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Principal string   // API key principal or Azure AD user principal name
+	Source    string   // the method that authenticated the caller, such as SourceAPIKey
+	Groups    []string // Azure AD groups, empty for API keys
+	Scopes    []string // API key scopes, empty for Azure AD users
+
+	apiKeyResult *apikey.Result // set by APIKeyAuthenticator
+}
+
+// HasGroup reports whether the identity is a member of group.
+func (id Identity) HasGroup(group string) bool {
+	return contains(id.Groups, group)
+}
+
+// HasScopes reports whether the identity is granted every one of scopes.
+func (id Identity) HasScopes(scopes ...string) bool {
+	for _, scope := range scopes {
+		if !contains(id.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// An Authenticator identifies the caller of a request. It returns
+// ErrNoCredentials if the request has none of its credentials, and otherwise
+// an Error, or any other error to reject the request as unauthorized.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+// A Preparer is an Authenticator that prepares the response and request once
+// it has identified the caller, before the handler is called. It returns an
+// error, as Authenticate does, to reject the request after all, such as when
+// a rate limit is exceeded.
+type Preparer interface {
+	Prepare(w http.ResponseWriter, r *http.Request, identity Identity) (*http.Request, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface.
+type AuthenticatorFunc func(r *http.Request) (Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (Identity, error) {
+	return f(r)
+}
+
+// Error is an authentication failure answered with StatusCode, such as 403
+// Forbidden for an API key used outside its allowed routes.
+type Error struct {
+	StatusCode int
+	Err        error
+	Header     http.Header // added to the response, such as Retry-After
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Middleware authenticates requests with each of Authenticators in turn. The
+// first to identify the caller wins. If none does, the request is rejected
+// with the failure of the first Authenticator that found its credentials, or
+// with apikey.ErrAuthorizationRequired if none did.
+type Middleware struct {
+	Authenticators []Authenticator
+
+	// ErrorWriter writes the responses of rejected requests. WriteError is
+	// used if it is nil.
+	ErrorWriter apikey.ErrorWriter
+}
+
+// Authenticate returns the identity of the caller of r, or the failure with
+// which to reject it. A Middleware is itself an Authenticator.
+func (m *Middleware) Authenticate(r *http.Request) (Identity, error) {
+	identity, _, err := m.authenticate(r)
+	return identity, err
+}
+
+// authenticate is like Authenticate, but also returns the Authenticator that
+// identified the caller.
+func (m *Middleware) authenticate(r *http.Request) (Identity, Authenticator, error) {
+	var failure error
+	for _, authenticator := range m.Authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if err == nil {
+			return identity, authenticator, nil
+		}
+		if failure == nil && !errors.Is(err, ErrNoCredentials) {
+			failure = err
+		}
+	}
+	if failure == nil {
+		return Identity{}, nil, ErrNoCredentials
+	}
+	return Identity{}, nil, failure
+}
+
+// Handler is an http.Handler that rejects requests that none of the
+// Authenticators identify, and otherwise stores the Identity in the request
+// context, see IdentityFromContext. If the Authenticator that identified the
+// caller is a Preparer, the request is prepared first.
+func (m *Middleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, authenticator, err := m.authenticate(r)
+		if err != nil {
+			m.reject(w, r, err)
+			return
+		}
+		if preparer, ok := authenticator.(Preparer); ok {
+			prepared, err := preparer.Prepare(w, r, identity)
+			if err != nil {
+				m.reject(w, r, err)
+				return
+			}
+			r = prepared
+		}
+		h.ServeHTTP(w, r.WithContext(NewContext(r.Context(), identity)))
+	})
+}
+
+// reject writes the response to a failed authentication.
+func (m *Middleware) reject(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		for name, values := range e.Header {
+			w.Header()[name] = values
+		}
+	}
+	status, err := failureStatus(err)
+	log.Printf("request failed authentication: status %d, %s", status, err)
+	m.writeError(w, r, status, err)
+}
+
+// failureStatus returns the status code and error of the response to a
+// failed authentication.
+func failureStatus(err error) (int, error) {
+	if errors.Is(err, ErrNoCredentials) {
+		return http.StatusUnauthorized, apikey.ErrAuthorizationRequired
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode, e.Err
+	}
+	return http.StatusUnauthorized, err
+}
+
+func (m *Middleware) writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if m.ErrorWriter != nil {
+		m.ErrorWriter(w, r, status, err)
+		return
+	}
+	WriteError(w, r, status, err)
+}
+
+// WriteError is the default ErrorWriter of Middleware. It writes an
+// apikey.Problem, with a WWW-Authenticate: Bearer challenge when status is
+// 401 Unauthorized, whichever Authenticator rejected the request.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	apikey.WriteProblem(w, apikey.Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: err.Error(),
+	})
+}
+
+type contextKey int
+
+const identityContextKey contextKey = iota
+
+// NewContext returns a copy of ctx carrying identity.
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey, identity)
+}
+
+// IdentityFromContext returns the identity stored in ctx by Middleware, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey).(Identity)
+	return identity, ok
+}
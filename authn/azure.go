@@ -0,0 +1,44 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/corbaltcode/go-libraries/azure"
+)
+
+var ErrInvalidToken = errors.New("invalid Azure AD token")
+
+// AzureADAuthenticator authenticates requests bearing an Azure AD token in
+// the Authorization header with AzureAD.VerifyTokenContext. Bearer tokens
+// that are not JWTs, such as API keys, are left to other Authenticators.
+type AzureADAuthenticator struct {
+	AzureAD *azure.AzureAD
+}
+
+func (a AzureADAuthenticator) Authenticate(r *http.Request) (Identity, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.Count(token, ".") != 2 {
+		return Identity{}, ErrNoCredentials
+	}
+	body, err := a.AzureAD.VerifyTokenContext(r.Context(), token)
+	if err != nil {
+		return Identity{}, &Error{StatusCode: http.StatusUnauthorized, Err: fmt.Errorf("%w: %s", ErrInvalidToken, err)}
+	}
+	return Identity{Principal: azurePrincipal(body), Source: SourceAzureAD, Groups: body.Groups}, nil
+}
+
+// azurePrincipal returns the user principal name of the token's subject,
+// falling back to its preferred username and then to its subject ID.
+func azurePrincipal(body *azure.JWTBody) string {
+	switch {
+	case body.Username != "":
+		return body.Username
+	case body.PreferredUsername != "":
+		return body.PreferredUsername
+	default:
+		return body.Subject
+	}
+}
@@ -0,0 +1,60 @@
+package azure
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cloud is a national cloud of Azure AD, each with its own authority host.
+type Cloud string
+
+const (
+	CloudPublic       Cloud = "public"
+	CloudUSGovernment Cloud = "usgov"
+	CloudChina        Cloud = "china"
+)
+
+// DefaultCloud is used when neither AzureADConfig.Cloud nor AuthorityHost is
+// set. It is the US Government cloud, which was the only one supported before
+// clouds could be selected.
+const DefaultCloud = CloudUSGovernment
+
+// authorityHosts are the authority hosts of the clouds. Their Microsoft Graph
+// hosts are not listed since they vary by tenant within a cloud, e.g.
+// dod-graph.microsoft.us; the discovery document names the right one.
+var authorityHosts = map[Cloud]string{
+	CloudPublic:       "login.microsoftonline.com",
+	CloudUSGovernment: "login.microsoftonline.us",
+	CloudChina:        "login.chinacloudapi.cn",
+}
+
+// ParseCloud returns the Cloud named s, which is one of "public", "usgov" and
+// "china".
+func ParseCloud(s string) (Cloud, error) {
+	cloud := Cloud(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := authorityHosts[cloud]; !ok {
+		return "", fmt.Errorf("unknown Azure cloud %q, should be one of %q, %q or %q", s, CloudPublic, CloudUSGovernment, CloudChina)
+	}
+	return cloud, nil
+}
+
+// AuthorityURL returns the URL of the authority that issues tokens for the
+// tenant, such as https://login.microsoftonline.com/<tenant ID>. The
+// issuer, discovery document and signing keys are all found under it.
+func (c AzureADConfig) AuthorityURL() (string, error) {
+	host := c.AuthorityHost
+	if host == "" {
+		cloud := c.Cloud
+		if cloud == "" {
+			cloud = DefaultCloud
+		}
+		var ok bool
+		if host, ok = authorityHosts[cloud]; !ok {
+			return "", fmt.Errorf("unknown Azure cloud %q", c.Cloud)
+		}
+	}
+	if !strings.Contains(host, "://") {
+		host = "https://" + host
+	}
+	return strings.TrimSuffix(host, "/") + "/" + c.TenantID, nil
+}
@@ -0,0 +1,51 @@
+package azure
+
+import "testing"
+
+func TestAzureADConfigAuthorityURL(t *testing.T) {
+	tests := []struct {
+		Name              string
+		Config            AzureADConfig
+		ExpectedAuthority string
+	}{
+		{Name: "Default", Config: AzureADConfig{TenantID: "tenant"}, ExpectedAuthority: "https://login.microsoftonline.us/tenant"},
+		{Name: "Public", Config: AzureADConfig{TenantID: "tenant", Cloud: CloudPublic}, ExpectedAuthority: "https://login.microsoftonline.com/tenant"},
+		{Name: "China", Config: AzureADConfig{TenantID: "tenant", Cloud: CloudChina}, ExpectedAuthority: "https://login.chinacloudapi.cn/tenant"},
+		{Name: "Authority host", Config: AzureADConfig{TenantID: "tenant", Cloud: CloudChina, AuthorityHost: "login.example.com/"}, ExpectedAuthority: "https://login.example.com/tenant"},
+		{Name: "Authority URL", Config: AzureADConfig{TenantID: "tenant", AuthorityHost: "http://127.0.0.1:8080"}, ExpectedAuthority: "http://127.0.0.1:8080/tenant"},
+	}
+	for _, test := range tests {
+		authority, err := test.Config.AuthorityURL()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.Name, err)
+		}
+		if authority != test.ExpectedAuthority {
+			t.Errorf("%s: expected authority %q but got %q", test.Name, test.ExpectedAuthority, authority)
+		}
+	}
+
+	if _, err := (AzureADConfig{Cloud: "moon"}).AuthorityURL(); err == nil {
+		t.Errorf("expected error for unknown cloud")
+	}
+}
+
+func TestGetConfigFromENVCloud(t *testing.T) {
+	t.Setenv("AZURE_AD_CLIENT_ID", "client")
+	t.Setenv("AZURE_AD_HOST", "app.example.com")
+	t.Setenv("AZURE_AD_REDIRECT_URL", "https://app.example.com/callback")
+	t.Setenv("AZURE_AD_TENANT_ID", "tenant")
+
+	t.Setenv("AZURE_AD_CLOUD", "Public")
+	config, err := GetConfigFromENV()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if config.Cloud != CloudPublic {
+		t.Errorf("expected cloud %q but got %q", CloudPublic, config.Cloud)
+	}
+
+	t.Setenv("AZURE_AD_CLOUD", "moon")
+	if _, err := GetConfigFromENV(); err == nil {
+		t.Errorf("expected error for unknown cloud")
+	}
+}
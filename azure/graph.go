@@ -1,6 +1,7 @@
 package azure
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -24,29 +25,39 @@ func (gg GraphGroups) Has(name string) bool {
 }
 
 func (aad *AzureAD) GetGraphGroups(accessToken string) (*GraphGroups, error) {
-	openIDConfig, err := aad.GetOpenIDConfig()
-	if err != nil {
-		return nil, err
+	return aad.GetGraphGroupsContext(context.Background(), accessToken)
+}
+
+// GetGraphGroupsContext is like GetGraphGroups, with ctx bounding the requests
+// to Microsoft Graph and, if needed, for the OpenID config.
+func (aad *AzureAD) GetGraphGroupsContext(ctx context.Context, accessToken string) (*GraphGroups, error) {
+	// The discovery document names the Graph host of the tenant unless one is
+	// configured.
+	graphHost := aad.AzureADConfig.GraphHost
+	if graphHost == "" {
+		openIDConfig, err := aad.GetOpenIDConfigContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		graphHost = openIDConfig.MSGraphHost
 	}
 
-	url := fmt.Sprintf("https://%s/beta/me/memberOf/microsoft.graph.group?$orderby=displayName&$select=displayName", openIDConfig.MSGraphHost)
+	url := fmt.Sprintf("https://%s/beta/me/memberOf/microsoft.graph.group?$orderby=displayName&$select=displayName", graphHost)
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Authorization", "Bearer "+accessToken)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := aad.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch user groups: %s", resp.Status)
 	}
 
-	defer resp.Body.Close()
-
 	groups := &GraphGroups{}
 
 	err = json.NewDecoder(resp.Body).Decode(groups)
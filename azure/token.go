@@ -7,6 +7,7 @@ import (
 	_ "crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -21,7 +22,11 @@ import (
 )
 
 type AzureAD struct {
-	AzureADConfig  AzureADConfig
+	AzureADConfig AzureADConfig
+	// HTTPClient makes the requests to Azure AD and Microsoft Graph. If nil, a
+	// client with a 30 second timeout is used.
+	HTTPClient *http.Client
+
 	provider       *oidc.Provider
 	providerMu     sync.Mutex
 	openIDConfig   *OpenIDConfig
@@ -34,6 +39,16 @@ type AzureADConfig struct {
 	ClientID            string
 	Host                string
 	TenantID            string
+
+	// Cloud selects the authority host. DefaultCloud is used if it and
+	// AuthorityHost are empty.
+	Cloud Cloud
+	// AuthorityHost, if set, is used instead of the Cloud's authority, e.g.
+	// "https://login.microsoftonline.com".
+	AuthorityHost string
+	// GraphHost, if set, is used instead of the Microsoft Graph host named by
+	// the tenant's discovery document, e.g. "graph.microsoft.com".
+	GraphHost string
 }
 
 func GetConfigFromENV() (AzureADConfig, error) {
@@ -53,8 +68,18 @@ func GetConfigFromENV() (AzureADConfig, error) {
 	readFromENV(&config.RedirectURL, "AZURE_AD_REDIRECT_URL")
 	readFromENV(&config.TenantID, "AZURE_AD_TENANT_ID")
 
+	// The cloud and hosts are optional.
+	if cloud := os.Getenv("AZURE_AD_CLOUD"); cloud != "" {
+		var err error
+		if config.Cloud, err = ParseCloud(cloud); err != nil {
+			invalid = append(invalid, fmt.Sprintf("environment variable %q is invalid: %s", "AZURE_AD_CLOUD", err))
+		}
+	}
+	config.AuthorityHost = os.Getenv("AZURE_AD_AUTHORITY_HOST")
+	config.GraphHost = os.Getenv("AZURE_AD_GRAPH_HOST")
+
 	if len(invalid) > 0 {
-		return AzureADConfig{}, fmt.Errorf(strings.Join(invalid, ", "))
+		return AzureADConfig{}, errors.New(strings.Join(invalid, ", "))
 	}
 
 	return config, nil
@@ -98,14 +123,29 @@ const (
 
 var maxAgeRegex = regexp.MustCompile(`^max-age=(\d+)`)
 
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+func (aad *AzureAD) httpClient() *http.Client {
+	if aad.HTTPClient != nil {
+		return aad.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
 // initial caller must check and record the nonce in caller to prevent replay attacks
 func (aad *AzureAD) VerifyToken(token string) (*JWTBody, error) {
+	return aad.VerifyTokenContext(context.Background(), token)
+}
+
+// VerifyTokenContext is like VerifyToken, with ctx bounding the requests for
+// the provider's discovery document and signing keys.
+func (aad *AzureAD) VerifyTokenContext(ctx context.Context, token string) (*JWTBody, error) {
 	tokenParts := strings.Split(token, ".")
 	if len(tokenParts) != 3 {
 		return nil, fmt.Errorf("invalid number of JWT token segments %d, should be 3", len(tokenParts))
 	}
 
-	bodyBytes, err := base64.RawStdEncoding.DecodeString(tokenParts[TokenBody])
+	bodyBytes, err := base64.RawURLEncoding.DecodeString(tokenParts[TokenBody])
 	if err != nil {
 		return nil, fmt.Errorf("error decoding JWT body: %s", err)
 	}
@@ -114,14 +154,14 @@ func (aad *AzureAD) VerifyToken(token string) (*JWTBody, error) {
 		return nil, fmt.Errorf("error unmarshalling JWT body json: %s", err)
 	}
 
-	provider, err := aad.GetProvider()
+	provider, err := aad.GetProviderContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	verifier := provider.Verifier(&oidc.Config{
 		ClientID: aad.AzureADConfig.ClientID,
 	})
-	_, err = verifier.Verify(context.Background(), token)
+	_, err = verifier.Verify(ctx, token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify ID token: %s", err)
 	}
@@ -129,8 +169,14 @@ func (aad *AzureAD) VerifyToken(token string) (*JWTBody, error) {
 	return &body, nil
 }
 
-// GetOpenIDConfig from Microsoft for CMSs tenant ID
+// GetOpenIDConfig from Microsoft for the configured tenant ID
 func (aad *AzureAD) GetOpenIDConfig() (*OpenIDConfig, error) {
+	return aad.GetOpenIDConfigContext(context.Background())
+}
+
+// GetOpenIDConfigContext is like GetOpenIDConfig, with ctx bounding the
+// request for the config when it is not cached.
+func (aad *AzureAD) GetOpenIDConfigContext(ctx context.Context) (*OpenIDConfig, error) {
 	aad.openIDConfigMu.Lock()
 	defer aad.openIDConfigMu.Unlock()
 
@@ -138,13 +184,22 @@ func (aad *AzureAD) GetOpenIDConfig() (*OpenIDConfig, error) {
 		return aad.openIDConfig, nil
 	}
 
+	authorityURL, err := aad.AzureADConfig.AuthorityURL()
+	if err != nil {
+		return nil, err
+	}
 	openIDConfig := &OpenIDConfig{}
-	openIDConfigURL := fmt.Sprintf("https://login.microsoftonline.us/%s/.well-known/openid-configuration", aad.AzureADConfig.TenantID)
+	openIDConfigURL := authorityURL + "/.well-known/openid-configuration"
 
-	resp, err := http.Get(openIDConfigURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openIDConfigURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := aad.httpClient().Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch OpenID config from %s: %s", openIDConfigURL, err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("failed to fetch OpenID config from %s: status: %s", openIDConfigURL, resp.Status)
 	}
@@ -159,7 +214,6 @@ func (aad *AzureAD) GetOpenIDConfig() (*OpenIDConfig, error) {
 		}
 	}
 
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
@@ -176,12 +230,23 @@ func (aad *AzureAD) GetOpenIDConfig() (*OpenIDConfig, error) {
 }
 
 func (aad *AzureAD) GetProvider() (*oidc.Provider, error) {
+	return aad.GetProviderContext(context.Background())
+}
+
+// GetProviderContext is like GetProvider, with ctx bounding the request for
+// the provider's discovery document when it is not cached. The provider
+// fetches signing keys with HTTPClient.
+func (aad *AzureAD) GetProviderContext(ctx context.Context) (*oidc.Provider, error) {
 	aad.providerMu.Lock()
 	defer aad.providerMu.Unlock()
 
 	if aad.provider == nil {
-		issuerURL := fmt.Sprintf("https://login.microsoftonline.us/%s/v2.0", aad.AzureADConfig.TenantID)
-		provider, err := oidc.NewProvider(context.Background(), issuerURL)
+		authorityURL, err := aad.AzureADConfig.AuthorityURL()
+		if err != nil {
+			return nil, err
+		}
+		issuerURL := authorityURL + "/v2.0"
+		provider, err := oidc.NewProvider(oidc.ClientContext(ctx, aad.httpClient()), issuerURL)
 		if err != nil {
 			return nil, fmt.Errorf("failed to instantiate provider: %s", err)
 		}
@@ -0,0 +1,114 @@
+package azure
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+func TestAzureADWithTestServer(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewTLSServer(mux)
+	defer server.Close()
+	authority := server.URL + "/tenant"
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/tenant/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		writeJSON(w, map[string]string{"jwks_uri": authority + "/keys", "msgraph_host": server.Listener.Addr().String()})
+	})
+	mux.HandleFunc("/tenant/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                authority + "/v2.0",
+			"jwks_uri":                              authority + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/tenant/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	})
+	mux.HandleFunc("/beta/me/memberOf/microsoft.graph.group", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer graph-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, GraphGroups{Items: []Items{{Name: "admins"}}})
+	})
+
+	aad := &AzureAD{
+		AzureADConfig: AzureADConfig{ClientID: "client", TenantID: "tenant", AuthorityHost: server.URL},
+		HTTPClient:    server.Client(),
+	}
+	ctx := context.Background()
+
+	now := time.Now()
+	token, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   authority + "/v2.0",
+		Audience: jwt.Audience{"client"},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}).Claims(map[string]interface{}{"upn": "user@example.com", "name": "Jöhn >>> Dœ ???"}).CompactSerialize()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// JWTs are base64url encoded, which differs from standard base64 in
+	// these characters.
+	if !strings.ContainsAny(strings.Split(token, ".")[TokenBody], "-_") {
+		t.Fatalf("expected token body to use base64url characters")
+	}
+	body, err := aad.VerifyTokenContext(ctx, token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if body.Username != "user@example.com" || body.Name != "Jöhn >>> Dœ ???" {
+		t.Errorf("unexpected token body %+v", body)
+	}
+	if _, err := aad.VerifyTokenContext(ctx, token+"x"); err == nil {
+		t.Errorf("expected error for tampered token")
+	}
+
+	openIDConfig, err := aad.GetOpenIDConfigContext(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if openIDConfig.JWKSURI != authority+"/keys" {
+		t.Errorf("unexpected OpenID config %+v", openIDConfig)
+	}
+	groups, err := aad.GetGraphGroupsContext(ctx, "graph-token")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !groups.Has("admins") {
+		t.Errorf("expected group admins, got %+v", groups)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	uncached := &AzureAD{AzureADConfig: aad.AzureADConfig, HTTPClient: server.Client()}
+	if _, err := uncached.GetOpenIDConfigContext(canceled); err == nil {
+		t.Errorf("expected error for canceled context")
+	}
+	if _, err := uncached.VerifyTokenContext(canceled, token); err == nil {
+		t.Errorf("expected error for canceled context")
+	}
+}
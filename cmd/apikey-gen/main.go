@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/corbaltcode/go-libraries/apikey"
+)
+
+func main() {
+	log.SetFlags(0) // no timestamps — keep output clean for CLI use
+
+	principal := flag.String("principal", "", "principal the key belongs to (required)")
+	scopes := flag.String("scopes", "", "comma-separated scopes granted to the key")
+	expires := flag.Duration("expires", 0, "lifetime of the key, e.g. 2160h; no expiry if zero")
+	useArgon2id := flag.Bool("argon2id", false, "store the key as an argon2id hash instead of sha256")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -principal <name> [-scopes a,b] [-expires 2160h] [-argon2id]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if strings.TrimSpace(*principal) == "" || flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	key, err := apikey.GenerateKey()
+	if err != nil {
+		log.Fatalf("failed to generate key: %v", err)
+	}
+
+	stored := apikey.HashKey(key.String())
+	if *useArgon2id {
+		if stored, err = apikey.HashKeyArgon2id(key.String()); err != nil {
+			log.Fatalf("failed to hash key: %v", err)
+		}
+	}
+
+	entry := apikey.Key{ID: key.ID, Value: stored}
+	if *scopes != "" {
+		for _, scope := range strings.Split(*scopes, ",") {
+			entry.Scopes = append(entry.Scopes, strings.TrimSpace(scope))
+		}
+	}
+	if *expires > 0 {
+		expiresAt := time.Now().UTC().Add(*expires).Truncate(time.Second)
+		entry.ExpiresAt = &expiresAt
+	}
+
+	config, err := json.MarshalIndent(apikey.APIKeyConfig{Principal: *principal, Keys: []apikey.Key{entry}}, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to encode config entry: %v", err)
+	}
+
+	fmt.Fprintln(os.Stderr, "API key (shown only once, give it to the client):")
+	fmt.Println(key.String())
+	fmt.Fprintln(os.Stderr, "Config entry for the principals array:")
+	fmt.Println(string(config))
+}